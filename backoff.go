@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// A tunnel that stayed up for this long is considered healthy, and its next
+// reconnect starts over from the minimum backoff.
+const backoffResetThreshold = time.Minute
+
+// Backoff doubles the delay from Min up to Max on every call to Next, with
+// ±20% jitter so that tunnels don't retry in lockstep.
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	current time.Duration
+}
+
+func (this *Backoff) Next() time.Duration {
+	if this.current == 0 {
+		this.current = this.Min
+	} else {
+		this.current *= 2
+		if this.current > this.Max {
+			this.current = this.Max
+		}
+	}
+	jitter := (rand.Float64()*0.4 - 0.2) * float64(this.current)
+	return (this.current + time.Duration(jitter)).Round(time.Millisecond)
+}
+
+func (this *Backoff) Reset() {
+	this.current = 0
+}
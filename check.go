@@ -0,0 +1,79 @@
+package main
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	k8sversion "k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Check connects to every context to confirm that the cluster is reachable
+// and the credentials work, and counts the pods that each tunnel's selector
+// matches. It returns the number of contexts that couldn't be reached.
+func Check(config Config) int {
+	failed := 0
+	for _, context := range config.Contexts {
+		log := Log{Context: context.Name}
+		_, clientSet, err := NewClient(context)
+		if err == nil {
+			var info *k8sversion.Info
+			info, err = serverVersion(clientSet)
+			if err == nil {
+				log.Infof("OK: %s is reachable, running Kubernetes %s.", context.Name, info.GitVersion)
+			}
+		}
+		if isAuthError(err) {
+			log.Errorf("FAIL: %s", credentialsError(context.Name, err).Error())
+			failed++
+			continue
+		} else if err != nil {
+			log.Errorf("FAIL: %s is not reachable: %s", context.Name, err.Error())
+			failed++
+			continue
+		}
+
+		for _, tunnel := range context.Tunnels {
+			log := Log{Context: context.Name, Tunnel: tunnel.Target(), Name: tunnel.Name}
+			var pods []v1.Pod
+			selectors, _, err := resolveSelector(gocontext.Background(), clientSet, tunnel)
+			if err == nil {
+				pods, err = listSelectorPods(gocontext.Background(), clientSet, tunnel, selectors)
+			}
+			if err != nil {
+				log.Errorf("FAIL: %s/%s: %s", tunnel.Namespace, tunnel.Target(), err.Error())
+				continue
+			}
+			ready := 0
+			for _, pod := range pods {
+				if podNotReadyReason(&pod) == "" {
+					ready++
+				}
+			}
+			if len(pods) == 0 {
+				log.Warnf("%s/%s matches no pods.", tunnel.Namespace, tunnel.Target())
+			} else {
+				log.Infof("OK: %s/%s matches %d pods, %d ready.", tunnel.Namespace, tunnel.Target(), len(pods), ready)
+			}
+		}
+	}
+	return failed
+}
+
+// serverVersion is the same as clientSet.Discovery().ServerVersion(), but
+// with a timeout.
+func serverVersion(clientSet *kubernetes.Clientset) (*k8sversion.Info, error) {
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), DefaultDiscoveryTimeout)
+	defer cancel()
+	body, err := clientSet.Discovery().RESTClient().Get().AbsPath("/version").Context(ctx).Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	info := &k8sversion.Info{}
+	if err := json.Unmarshal(body, info); err != nil {
+		return nil, fmt.Errorf("Could not parse the server version: %s", err.Error())
+	}
+	return info, nil
+}
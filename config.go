@@ -0,0 +1,1284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+type Config struct {
+	LogFormat     string    `toml:"log_format" yaml:"log_format"`
+	LogLevel      string    `toml:"log_level" yaml:"log_level"`
+	LogFile       string    `toml:"log_file" yaml:"log_file"`
+	LogMaxSizeMB  int       `toml:"log_max_size_mb" yaml:"log_max_size_mb"`
+	LogMaxBackups *int      `toml:"log_max_backups" yaml:"log_max_backups"`
+	MetricsAddr   string    `toml:"metrics_addr" yaml:"metrics_addr"`
+	HealthAddr    string    `toml:"health_addr" yaml:"health_addr"`
+	OtelEndpoint  string    `toml:"otel_endpoint" yaml:"otel_endpoint"`
+	ControlSocket string    `toml:"control_socket" yaml:"control_socket"`
+	Protocol      string    `toml:"protocol" yaml:"protocol"`
+	QPS           Rate      `toml:"qps" yaml:"qps"`
+	Burst         int       `toml:"burst" yaml:"burst"`
+	StopAfter     Duration  `toml:"stop_after" yaml:"stop_after"`
+	Default       Tunnel    `toml:"default" yaml:"default"`
+	Contexts      []Context `toml:"context" yaml:"context"`
+}
+type Context struct {
+	Name              string
+	Kubeconfig        string   `toml:"kubeconfig" yaml:"kubeconfig"`
+	InCluster         bool     `toml:"in_cluster" yaml:"in_cluster"`
+	Server            string   `toml:"server" yaml:"server"`
+	Token             string   `toml:"token" yaml:"token"`
+	TokenFile         string   `toml:"token_file" yaml:"token_file"`
+	CAFile            string   `toml:"ca_file" yaml:"ca_file"`
+	Insecure          bool     `toml:"insecure_skip_tls_verify" yaml:"insecure_skip_tls_verify"`
+	ImpersonateUser   string   `toml:"impersonate_user" yaml:"impersonate_user"`
+	ImpersonateGroups []string `toml:"impersonate_groups" yaml:"impersonate_groups"`
+	Protocol          string   `toml:"protocol" yaml:"protocol"`
+	ProxyURL          string   `toml:"proxy_url" yaml:"proxy_url"`
+	QPS               Rate     `toml:"qps" yaml:"qps"`
+	Burst             int      `toml:"burst" yaml:"burst"`
+	Default           Tunnel   `toml:"default" yaml:"default"`
+	Tunnels           []Tunnel `toml:"tunnel" yaml:"tunnel"`
+}
+type Tunnel struct {
+	Name                   string
+	Description            string `toml:"description" yaml:"description"`
+	Namespace              string
+	Selector               StringList
+	FieldSelector          string `toml:"field_selector" yaml:"field_selector"`
+	Failover               StringList
+	Service                string
+	Pod                    string
+	Resource               string
+	Protocol               string        `toml:"protocol" yaml:"protocol"`
+	PodPort                NamedPort     `toml:"pod_port" yaml:"pod_port"`
+	LocalPort              AutoPort      `toml:"local_port" yaml:"local_port"`
+	LocalPortBase          int           `toml:"local_port_base" yaml:"local_port_base"`
+	Ports                  []PortMapping `toml:"ports" yaml:"ports"`
+	BindAddress            StringList    `toml:"bind_address" yaml:"bind_address"`
+	ReconnectInterval      Duration      `toml:"reconnect_interval" yaml:"reconnect_interval"`
+	MinBackoff             Duration      `toml:"min_backoff" yaml:"min_backoff"`
+	MaxBackoff             Duration      `toml:"max_backoff" yaml:"max_backoff"`
+	WaitForReady           bool          `toml:"wait_for_ready" yaml:"wait_for_ready"`
+	WaitForPod             bool          `toml:"wait_for_pod" yaml:"wait_for_pod"`
+	DiscoveryRetryInterval Duration      `toml:"discovery_retry_interval" yaml:"discovery_retry_interval"`
+	ReadyTimeout           Duration      `toml:"ready_timeout" yaml:"ready_timeout"`
+	DiscoveryTimeout       Duration      `toml:"discovery_timeout" yaml:"discovery_timeout"`
+	StartupJitter          Duration      `toml:"startup_jitter" yaml:"startup_jitter"`
+	DialTimeout            Duration      `toml:"dial_timeout" yaml:"dial_timeout"`
+	IdleTimeout            Duration      `toml:"idle_timeout" yaml:"idle_timeout"`
+	MaxLifetime            Duration      `toml:"max_lifetime" yaml:"max_lifetime"`
+	TCPKeepalive           Duration      `toml:"tcp_keepalive" yaml:"tcp_keepalive"`
+	IOTimeout              Duration      `toml:"io_timeout" yaml:"io_timeout"`
+	DrainTimeout           Duration      `toml:"drain_timeout" yaml:"drain_timeout"`
+	MaxConnections         int           `toml:"max_connections" yaml:"max_connections"`
+	MaxConnectionsAction   string        `toml:"max_connections_action" yaml:"max_connections_action"`
+	MaxReconnects          int           `toml:"max_reconnects" yaml:"max_reconnects"`
+	ExitOnFailure          bool          `toml:"exit_on_failure" yaml:"exit_on_failure"`
+	Once                   bool
+	Enabled                *bool
+	Tags                   StringList
+	Mode                   string
+	Select                 string
+	Watch                  bool
+	Sticky                 bool
+	Socks                  bool
+	StrictPorts            bool   `toml:"strict_ports" yaml:"strict_ports"`
+	TLS                    *TLS   `toml:"tls" yaml:"tls"`
+	OnReady                string `toml:"on_ready" yaml:"on_ready"`
+	OnStop                 string `toml:"on_stop" yaml:"on_stop"`
+	// set holds the keys that the config sets for the tunnel, so that an
+	// explicit false or "" isn't replaced by a default. It is nil for
+	// tunnels that weren't decoded from a config.
+	set map[string]bool
+}
+
+// How a tunnel picks the pods it forwards to.
+const (
+	ModeFirst      = "first"
+	ModeRoundRobin = "round-robin"
+	// fanout forwards to every pod at once, on the ports from
+	// local_port_base.
+	ModeFanout = "fanout"
+)
+
+// What happens to new local connections when a tunnel has max_connections
+// open. queue makes them wait for one to close.
+const (
+	LimitQueue  = "queue"
+	LimitReject = "reject"
+)
+
+const (
+	SelectNewest = "newest"
+	SelectOldest = "oldest"
+)
+
+// AllNamespaces is the namespace of tunnels that look for their pods in every
+// namespace.
+const AllNamespaces = "*"
+
+// The port-forward protocols. auto tries WebSocket first and falls back to
+// SPDY if the cluster doesn't support it.
+const (
+	ProtocolSPDY      = "spdy"
+	ProtocolWebSocket = "websocket"
+	ProtocolAuto      = "auto"
+)
+
+// The protocols of a tunnel's ports. Port-forwarding only forwards TCP, so udp
+// is only recognized to explain that.
+const (
+	PortProtocolTCP = "tcp"
+	PortProtocolUDP = "udp"
+)
+
+// errUDP explains why UDP can't be forwarded.
+const errUDP = "port-forwarding only forwards TCP, so UDP services like DNS can't be tunneled. Run a relay like socat in the pod that forwards a TCP port to the UDP one, and forward that port instead"
+
+// InClusterContextName is the name given to an in_cluster context without a
+// name.
+const InClusterContextName = "in-cluster"
+
+// The API requests of a context, like looking up pods, are limited to
+// DefaultQPS per second with bursts of DefaultBurst, the same as kubectl.
+const (
+	DefaultQPS   = 5
+	DefaultBurst = 10
+)
+
+// reconnect_interval is how often the forwarded pod is checked for deletion,
+// while the delay between reconnects is controlled by min_backoff and
+// max_backoff.
+const (
+	DefaultReconnectInterval      = 3 * time.Second
+	DefaultMinBackoff             = 1 * time.Second
+	DefaultMaxBackoff             = 30 * time.Second
+	DefaultReadyTimeout           = 60 * time.Second
+	DefaultDiscoveryTimeout       = 10 * time.Second
+	DefaultDialTimeout            = 10 * time.Second
+	DefaultDiscoveryRetryInterval = 5 * time.Second
+	DefaultTCPKeepalive           = 15 * time.Second
+	DefaultBindAddress            = "127.0.0.1"
+	DefaultLogMaxSizeMB           = 100
+	DefaultLogMaxBackups          = 3
+)
+
+type Duration struct {
+	time.Duration
+}
+
+func (this *Duration) UnmarshalText(text []byte) error {
+	var err error
+	this.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// NamedPort is either a port number or the name of a container port.
+type NamedPort struct {
+	Number int
+	Name   string
+}
+
+// checkPort returns an error if n is not a valid port number.
+func checkPort(n int64) error {
+	if n < 1 || n > 65535 {
+		return fmt.Errorf("port %d is not in the range 1-65535", n)
+	}
+	return nil
+}
+
+func (this *NamedPort) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case int64:
+		if err := checkPort(v); err != nil {
+			return err
+		}
+		this.Number = int(v)
+	case string:
+		if n, err := strconv.Atoi(v); err == nil {
+			if err := checkPort(int64(n)); err != nil {
+				return err
+			}
+			this.Number = n
+		} else {
+			this.Name = v
+		}
+	default:
+		return fmt.Errorf("expected a port number or name but found %T", data)
+	}
+	return nil
+}
+
+func (this NamedPort) String() string {
+	if this.Name != "" {
+		return this.Name
+	}
+	return strconv.Itoa(this.Number)
+}
+
+// Rate is a number of requests per second. Unlike a plain float, it can be
+// written as an integer in TOML.
+type Rate float32
+
+func (this *Rate) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case int64:
+		*this = Rate(v)
+	case float64:
+		*this = Rate(v)
+	default:
+		return fmt.Errorf("expected a number but found %T", data)
+	}
+	return nil
+}
+
+// AutoPort is a local port number, or "auto" (or 0) to pick a free port.
+// When it's not set, SetDefaults uses the pod port.
+type AutoPort int
+
+// autoPortSet marks an explicit "auto" until SetDefaults turns it into 0.
+const autoPortSet AutoPort = -1
+
+func (this *AutoPort) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case int64:
+		if v != 0 {
+			if err := checkPort(v); err != nil {
+				return fmt.Errorf("%s (or \"auto\" to pick a free port)", err.Error())
+			}
+		}
+		*this = AutoPort(v)
+	case string:
+		if v != "auto" {
+			return fmt.Errorf("expected a port number or \"auto\" but found %q", v)
+		}
+		*this = 0
+	default:
+		return fmt.Errorf("expected a port number or \"auto\" but found %T", data)
+	}
+	if *this == 0 {
+		*this = autoPortSet
+	}
+	return nil
+}
+
+// PortMapping is a "local:pod" pair from a tunnel's ports list. The local
+// port can be "auto", and a single number is used for both. It can start with
+// an IP address to listen on instead of the tunnel's bind_address, like
+// "192.168.1.10:8080:80" or "[::1]:8080:80".
+type PortMapping struct {
+	Address string
+	Local   int
+	Pod     NamedPort
+}
+
+func (this *PortMapping) UnmarshalTOML(data interface{}) error {
+	s, ok := data.(string)
+	if !ok {
+		return fmt.Errorf("expected a \"local:pod\" port mapping but found %T", data)
+	}
+	address, ports, err := splitMappingAddress(s)
+	if err != nil {
+		return err
+	}
+	this.Address = address
+	return this.unmarshalPorts(s, ports)
+}
+
+// splitMappingAddress splits the IP address off of a port mapping, if it has
+// one.
+func splitMappingAddress(s string) (string, string, error) {
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]:")
+		if end < 0 {
+			return "", "", fmt.Errorf("%q: expected \"[address]:local:pod\"", s)
+		}
+		address := s[1:end]
+		if ip := net.ParseIP(address); ip == nil || ip.To4() != nil {
+			return "", "", fmt.Errorf("%q: %q is not an IPv6 address", s, address)
+		}
+		return address, s[end+2:], nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return "", "", fmt.Errorf("%q: IPv6 addresses must be in brackets, like \"[::1]:8080:80\"", s)
+	}
+	if len(parts) == 3 || len(parts) == 2 && net.ParseIP(parts[0]) != nil {
+		if net.ParseIP(parts[0]) == nil {
+			return "", "", fmt.Errorf("%q: %q is not an IP address", s, parts[0])
+		}
+		return parts[0], strings.Join(parts[1:], ":"), nil
+	}
+	return "", s, nil
+}
+
+// unmarshalPorts parses the ports of the mapping s, after its address.
+func (this *PortMapping) unmarshalPorts(s string, ports string) error {
+	parts := strings.SplitN(ports, ":", 2)
+	if len(parts) == 1 {
+		// A single port number is used for both ends.
+		port, err := strconv.Atoi(ports)
+		if err != nil {
+			return fmt.Errorf("expected a \"local:pod\" port mapping but found %q", s)
+		}
+		if err := checkPort(int64(port)); err != nil {
+			return fmt.Errorf("%q: %s", s, err.Error())
+		}
+		this.Local, this.Pod = port, NamedPort{Number: port}
+		return nil
+	}
+	if parts[0] != "auto" {
+		local, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return fmt.Errorf("invalid local port in %q", s)
+		}
+		if err := checkPort(int64(local)); err != nil {
+			return fmt.Errorf("%q: local %s", s, err.Error())
+		}
+		this.Local = local
+	}
+	if err := this.Pod.UnmarshalTOML(parts[1]); err != nil {
+		return fmt.Errorf("%q: pod %s", s, err.Error())
+	}
+	return nil
+}
+
+func (this PortMapping) String() string {
+	if this.Address != "" {
+		return fmt.Sprintf("%s:%s", net.JoinHostPort(this.Address, strconv.Itoa(this.Local)), this.Pod)
+	}
+	return fmt.Sprintf("%d:%s", this.Local, this.Pod)
+}
+
+// unmarshalYAML decodes a YAML value the same way as the TOML decoder would
+// present it, so that the UnmarshalTOML methods can be shared.
+func unmarshalYAML(unmarshal func(interface{}) error, into interface{ UnmarshalTOML(interface{}) error }) error {
+	var data interface{}
+	if err := unmarshal(&data); err != nil {
+		return err
+	}
+	if n, ok := data.(int); ok {
+		data = int64(n)
+	}
+	return into.UnmarshalTOML(data)
+}
+
+func (this *NamedPort) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return unmarshalYAML(unmarshal, this)
+}
+
+func (this *Rate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return unmarshalYAML(unmarshal, this)
+}
+
+func (this *AutoPort) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return unmarshalYAML(unmarshal, this)
+}
+
+func (this *PortMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Unquoted single ports are numbers in YAML.
+	var data interface{}
+	if err := unmarshal(&data); err != nil {
+		return err
+	}
+	if n, ok := data.(int); ok {
+		data = strconv.Itoa(n)
+	}
+	return this.UnmarshalTOML(data)
+}
+
+func (this *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return unmarshalYAML(unmarshal, this)
+}
+
+// StringList accepts either a single string or a list of strings.
+type StringList []string
+
+func (this *StringList) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		*this = StringList{v}
+	case []interface{}:
+		list := make(StringList, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected a list of strings but found %T", item)
+			}
+			list[i] = s
+		}
+		*this = list
+	default:
+		return fmt.Errorf("expected a string or a list of strings but found %T", data)
+	}
+	return nil
+}
+
+func (this *Config) SetDefaults() {
+	if this.LogMaxSizeMB == 0 {
+		this.LogMaxSizeMB = DefaultLogMaxSizeMB
+	}
+	if this.LogMaxBackups == nil {
+		backups := DefaultLogMaxBackups
+		this.LogMaxBackups = &backups
+	}
+	for i := range this.Contexts {
+		context := &this.Contexts[i]
+		if context.InCluster && context.Name == "" {
+			context.Name = InClusterContextName
+		}
+		if context.Server != "" && context.Name == "" {
+			if u, err := url.Parse(context.Server); err == nil && u.Host != "" {
+				context.Name = u.Host
+			}
+		}
+		if context.Protocol == "" {
+			context.Protocol = this.Protocol
+		}
+		if context.Protocol == "" {
+			context.Protocol = ProtocolSPDY
+		}
+		if context.QPS == 0 {
+			context.QPS = this.QPS
+		}
+		if context.QPS == 0 {
+			context.QPS = DefaultQPS
+		}
+		if context.Burst == 0 {
+			context.Burst = this.Burst
+		}
+		if context.Burst == 0 {
+			context.Burst = DefaultBurst
+		}
+		for j := range context.Tunnels {
+			tunnel := &context.Tunnels[j]
+			tunnel.inherit(context.Default)
+			tunnel.inherit(this.Default)
+			if tunnel.ReconnectInterval.Duration == 0 {
+				tunnel.ReconnectInterval.Duration = DefaultReconnectInterval
+			}
+			if tunnel.MinBackoff.Duration == 0 {
+				tunnel.MinBackoff.Duration = DefaultMinBackoff
+			}
+			if tunnel.MaxBackoff.Duration == 0 {
+				tunnel.MaxBackoff.Duration = DefaultMaxBackoff
+			}
+			if tunnel.ReadyTimeout.Duration == 0 {
+				tunnel.ReadyTimeout.Duration = DefaultReadyTimeout
+			}
+			if tunnel.DiscoveryTimeout.Duration == 0 {
+				tunnel.DiscoveryTimeout.Duration = DefaultDiscoveryTimeout
+			}
+			if tunnel.Mode == ModeFanout && tunnel.LocalPortBase != 0 {
+				tunnel.LocalPort = AutoPort(tunnel.LocalPortBase)
+			} else if tunnel.LocalPort == 0 {
+				tunnel.LocalPort = AutoPort(tunnel.PodPort.Number)
+			} else if tunnel.LocalPort == autoPortSet {
+				tunnel.LocalPort = 0
+			}
+			if tunnel.DialTimeout.Duration == 0 {
+				tunnel.DialTimeout.Duration = DefaultDialTimeout
+			}
+			if tunnel.TCPKeepalive.Duration == 0 {
+				tunnel.TCPKeepalive.Duration = DefaultTCPKeepalive
+			}
+			if tunnel.DiscoveryRetryInterval.Duration == 0 {
+				tunnel.DiscoveryRetryInterval.Duration = DefaultDiscoveryRetryInterval
+			}
+			if len(tunnel.BindAddress) == 0 {
+				tunnel.BindAddress = StringList{DefaultBindAddress}
+			}
+		}
+	}
+}
+
+// inheritedKeys are the settings that tunnels take from the defaults. What a
+// tunnel forwards to, like its name, selector, pod and ports, is never
+// inherited.
+var inheritedKeys = map[string]bool{
+	"namespace":                true,
+	"field_selector":           true,
+	"bind_address":             true,
+	"reconnect_interval":       true,
+	"min_backoff":              true,
+	"max_backoff":              true,
+	"wait_for_ready":           true,
+	"wait_for_pod":             true,
+	"discovery_retry_interval": true,
+	"ready_timeout":            true,
+	"discovery_timeout":        true,
+	"startup_jitter":           true,
+	"dial_timeout":             true,
+	"idle_timeout":             true,
+	"max_lifetime":             true,
+	"tcp_keepalive":            true,
+	"io_timeout":               true,
+	"drain_timeout":            true,
+	"max_connections":          true,
+	"max_connections_action":   true,
+	"max_reconnects":           true,
+	"exit_on_failure":          true,
+	"once":                     true,
+	"enabled":                  true,
+	"tags":                     true,
+	"mode":                     true,
+	"select":                   true,
+	"watch":                    true,
+	"sticky":                   true,
+	"strict_ports":             true,
+	"tls":                      true,
+	"on_ready":                 true,
+	"on_stop":                  true,
+	"protocol":                 true,
+}
+
+// inherit sets the settings in inheritedKeys that the tunnel leaves unset to
+// the ones in defaults.
+func (this *Tunnel) inherit(defaults Tunnel) {
+	tunnel := reflect.ValueOf(this).Elem()
+	from := reflect.ValueOf(defaults)
+	for i := 0; i < tunnel.NumField(); i++ {
+		key := tunnelKey(tunnel.Type().Field(i))
+		if !inheritedKeys[key] || this.isSet(key, tunnel.Field(i)) || !defaults.isSet(key, from.Field(i)) {
+			continue
+		}
+		tunnel.Field(i).Set(from.Field(i))
+		if this.set == nil {
+			this.set = make(map[string]bool)
+		}
+		this.set[key] = true
+	}
+}
+
+// isSet returns true if the config sets key for the tunnel, even to false or
+// "", or if field isn't its zero value.
+func (this Tunnel) isSet(key string, field reflect.Value) bool {
+	return this.set[key] || !field.IsZero()
+}
+
+// tunnelKey returns the config key of a Tunnel field.
+func tunnelKey(field reflect.StructField) string {
+	if tag := field.Tag.Get("toml"); tag != "" {
+		return tag
+	}
+	return strings.ToLower(field.Name)
+}
+
+// markSetKeys records which keys the config sets in the defaults and the
+// tunnels, since an explicit false can't be told apart from a missing key
+// once it is decoded.
+func (this *Config) markSetKeys(format string, data []byte) {
+	var doc interface{}
+	var err error
+	if format == FormatYAML {
+		err = yaml.Unmarshal(data, &doc)
+	} else {
+		_, err = toml.Decode(string(data), &doc)
+	}
+	root, ok := asMap(doc)
+	if err != nil || !ok {
+		return
+	}
+	this.Default.set = keySet(root["default"])
+	for i, item := range asList(root["context"]) {
+		if i >= len(this.Contexts) {
+			break
+		}
+		context := asMapOrEmpty(item)
+		this.Contexts[i].Default.set = keySet(context["default"])
+		for j, item := range asList(context["tunnel"]) {
+			if j < len(this.Contexts[i].Tunnels) {
+				this.Contexts[i].Tunnels[j].set = keySet(item)
+			}
+		}
+	}
+}
+
+// keySet returns the keys of a decoded table, lower-cased since TOML matches
+// them to the fields regardless of case.
+func keySet(v interface{}) map[string]bool {
+	set := make(map[string]bool)
+	for key := range asMapOrEmpty(v) {
+		set[strings.ToLower(key)] = true
+	}
+	return set
+}
+
+// DisplayName returns the tunnel's name, or an id like
+// "prod/default/app=api:8080" made from where it forwards to and its first
+// local port if it has no name.
+func (this Tunnel) DisplayName(context string) string {
+	if this.Name != "" {
+		return this.Name
+	}
+	return fmt.Sprintf("%s/%s/%s:%s", context, this.Namespace, this.Target(), describeLocalPort(this.PortMappings()[0].Local))
+}
+
+// ReadyPodsOnly returns true if the tunnel only forwards to ready pods. That
+// is the case with wait_for_ready, and for services, workloads, failover,
+// round-robin, select and all namespaces.
+func (this Tunnel) ReadyPodsOnly() bool {
+	return this.WaitForReady || this.Service != "" || this.Resource != "" || this.Mode == ModeRoundRobin || this.Select != "" || len(this.Failover) > 0 || this.Namespace == AllNamespaces
+}
+
+// Target describes what the tunnel forwards to, for use in log messages.
+func (this Tunnel) Target() string {
+	if this.Pod != "" {
+		return "pod/" + this.Pod
+	}
+	if this.Service != "" {
+		return "service/" + this.Service
+	}
+	if this.Resource != "" {
+		return this.Resource
+	}
+	return describeSelectors(this.Selector, this.FieldSelector)
+}
+
+// describeSelectors describes label selectors that are combined with a field
+// selector, like "app=a or app=b,status.phase=Running".
+func describeSelectors(selectors []string, fieldSelector string) string {
+	description := strings.Join(selectors, " or ")
+	if description == "" {
+		return fieldSelector
+	}
+	if fieldSelector == "" {
+		return description
+	}
+	return description + "," + fieldSelector
+}
+
+// BindAddresses returns the addresses to listen on for mapping, which are
+// the tunnel's bind_address unless the mapping has its own.
+func (this Tunnel) BindAddresses(mapping PortMapping) []string {
+	if mapping.Address != "" {
+		return []string{mapping.Address}
+	}
+	return this.BindAddress
+}
+
+// PortMappings returns all of the tunnel's ports, starting with the
+// local_port and pod_port pair if it is set.
+func (this Tunnel) PortMappings() []PortMapping {
+	var mappings []PortMapping
+	if this.PodPort != (NamedPort{}) || len(this.Ports) == 0 {
+		mappings = append(mappings, PortMapping{Local: int(this.LocalPort), Pod: this.PodPort})
+	}
+	return append(mappings, this.Ports...)
+}
+
+func (this Tunnel) IsEnabled() bool {
+	return this.Enabled == nil || *this.Enabled
+}
+
+func (this Tunnel) HasAnyTag(tags []string) bool {
+	for _, tag := range tags {
+		for _, t := range this.Tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (this *Config) NumTunnels() int {
+	n := 0
+	for _, context := range this.Contexts {
+		n += len(context.Tunnels)
+	}
+	return n
+}
+
+// MaxDrainTimeout returns the longest drain_timeout of the tunnels.
+func (this *Config) MaxDrainTimeout() time.Duration {
+	var max time.Duration
+	for _, context := range this.Contexts {
+		for _, tunnel := range context.Tunnels {
+			if tunnel.DrainTimeout.Duration > max {
+				max = tunnel.DrainTimeout.Duration
+			}
+		}
+	}
+	return max
+}
+
+// SetOnce makes every tunnel stop after its first connection, for -once.
+func (this *Config) SetOnce() {
+	for i := range this.Contexts {
+		for j := range this.Contexts[i].Tunnels {
+			this.Contexts[i].Tunnels[j].Once = true
+		}
+	}
+}
+
+// FilterTunnels drops disabled tunnels, and tunnels without any of the tags
+// if tags is not empty. It returns how many tunnels were dropped for each
+// reason.
+func (this *Config) FilterTunnels(tags []string) (disabled int, untagged int) {
+	for i := range this.Contexts {
+		context := &this.Contexts[i]
+		var tunnels []Tunnel
+		for _, tunnel := range context.Tunnels {
+			if !tunnel.IsEnabled() {
+				disabled++
+			} else if len(tags) > 0 && !tunnel.HasAnyTag(tags) {
+				untagged++
+			} else {
+				tunnels = append(tunnels, tunnel)
+			}
+		}
+		context.Tunnels = tunnels
+	}
+	return disabled, untagged
+}
+
+const configFetchTimeout = 30 * time.Second
+
+// toml only reports an approximate line number, as part of the message.
+var tomlParseError = regexp.MustCompile(`^Near line (\d+) \(last key parsed '(.*?)'\): (?s:(.*))$`)
+
+// DecodeError rewrites a toml parse error as "path:line: message", so that
+// it is easier to find the mistake.
+func DecodeError(path string, err error) error {
+	m := tomlParseError.FindStringSubmatch(err.Error())
+	if m == nil {
+		return fmt.Errorf("Could not parse %s: %s", path, err.Error())
+	}
+	if m[2] == "" {
+		return fmt.Errorf("%s:%s: %s", path, m[1], m[3])
+	}
+	return fmt.Errorf("%s:%s: %s (after key %s)", path, m[1], m[3], m[2])
+}
+
+const (
+	FormatTOML = "toml"
+	FormatYAML = "yaml"
+)
+
+// isURL returns true if path is an http or https URL rather than a file.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// ConfigFormat guesses the format from the extension of path, and defaults
+// to TOML.
+func ConfigFormat(path string) string {
+	if u, err := url.Parse(path); err == nil && (u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "configmap") {
+		path = u.Path
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	}
+	return FormatTOML
+}
+
+// DecodeConfig decodes data in the given format.
+func DecodeConfig(path string, format string, data []byte) (Config, error) {
+	var config Config
+	if format == FormatYAML {
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			if located := locateDecodeError(format, data); located != nil {
+				err = located
+			}
+			return Config{}, fmt.Errorf("Could not parse %s: %s", path, err.Error())
+		}
+		config.markSetKeys(format, data)
+		return config, nil
+	}
+	if _, err := toml.Decode(string(data), &config); err != nil {
+		if located := locateDecodeError(format, data); located != nil {
+			return Config{}, fmt.Errorf("Could not parse %s: %s", path, located.Error())
+		}
+		return Config{}, DecodeError(path, err)
+	}
+	config.markSetKeys(format, data)
+	return config, nil
+}
+
+// locateDecodeError finds the key that a decoding error comes from, since
+// neither decoder says which key a value like "15x" or 70000 was rejected
+// for. Every key is decoded on its own until one fails. It returns nil if the
+// error is not about a single value, e.g. a syntax error.
+func locateDecodeError(format string, data []byte) error {
+	var doc interface{}
+	var err error
+	if format == FormatYAML {
+		err = yaml.Unmarshal(data, &doc)
+	} else {
+		_, err = toml.Decode(string(data), &doc)
+	}
+	root, ok := asMap(doc)
+	if err != nil || !ok {
+		return nil
+	}
+	if err := locateKeyError(format, root, &Config{}, "", "context", "default"); err != nil {
+		return err
+	}
+	if err := locateKeyError(format, asMapOrEmpty(root["default"]), &Tunnel{}, "default: "); err != nil {
+		return err
+	}
+	for i, item := range asList(root["context"]) {
+		context, _ := asMap(item)
+		where := fmt.Sprintf("context #%d", i+1)
+		if name, ok := context["name"].(string); ok {
+			where = fmt.Sprintf("context %q", name)
+		}
+		if err := locateKeyError(format, context, &Context{}, where+": ", "tunnel", "default"); err != nil {
+			return err
+		}
+		if err := locateKeyError(format, asMapOrEmpty(context["default"]), &Tunnel{}, where+" default: "); err != nil {
+			return err
+		}
+		for j, item := range asList(context["tunnel"]) {
+			tunnel, _ := asMap(item)
+			if err := locateKeyError(format, tunnel, &Tunnel{}, fmt.Sprintf("%s tunnel #%d: ", where, j+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// locateKeyError decodes every key in values, except for the skipped ones,
+// into into on its own, and returns the first error.
+func locateKeyError(format string, values map[string]interface{}, into interface{}, where string, skip ...string) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+keys:
+	for _, key := range keys {
+		for _, s := range skip {
+			if key == s {
+				continue keys
+			}
+		}
+		var err error
+		if format == FormatYAML {
+			var data []byte
+			data, err = yaml.Marshal(map[string]interface{}{key: values[key]})
+			if err == nil {
+				err = yaml.Unmarshal(data, into)
+			}
+		} else {
+			var buf bytes.Buffer
+			err = toml.NewEncoder(&buf).Encode(map[string]interface{}{key: values[key]})
+			if err == nil {
+				_, err = toml.Decode(buf.String(), into)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s%s: %s", where, key, err.Error())
+		}
+	}
+	return nil
+}
+
+// asMap returns v as a map, whether it was decoded from TOML or YAML.
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = value
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+func asMapOrEmpty(v interface{}) map[string]interface{} {
+	m, _ := asMap(v)
+	return m
+}
+
+// asList returns v as a list, whether it was decoded from TOML or YAML.
+func asList(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		return v
+	case []map[string]interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = item
+		}
+		return list
+	}
+	return nil
+}
+
+// ReadConfig reads the config from stdin if path is "-", fetches it if path
+// is an http or https URL, reads it from a ConfigMap for a configmap:// URL,
+// and otherwise reads it from the file.
+func ReadConfig(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	if isConfigMap(path) {
+		return readConfigMap(path)
+	}
+	if isURL(path) {
+		client := &http.Client{
+			Timeout: configFetchTimeout,
+		}
+		resp, err := client.Get(path)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("server responded with %s", resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// ExpandEnv replaces $VAR and ${VAR} in the config with the environment
+// variable, or with default for ${VAR:-default} when it is unset. $$ is a
+// literal $. Comment lines are left alone. It is an error to reference an
+// unset variable without a default.
+func ExpandEnv(data []byte) ([]byte, error) {
+	var unset []string
+	lines := strings.SplitAfter(string(data), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		lines[i] = os.Expand(line, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			name, def, hasDefault := name, "", false
+			if n := strings.Index(name, ":-"); n != -1 {
+				name, def, hasDefault = name[:n], name[n+2:], true
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok || hasDefault && value == "" {
+				if !hasDefault {
+					unset = append(unset, fmt.Sprintf("%s (line %d)", name, i+1))
+				}
+				return def
+			}
+			return value
+		})
+	}
+	if len(unset) > 0 {
+		return nil, fmt.Errorf("The config references unset environment variables: %s", strings.Join(unset, ", "))
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// FilterContexts drops every context that isn't in names, and returns the
+// names that didn't match any context.
+func (this *Config) FilterContexts(names []string) []string {
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = false
+	}
+	var contexts []Context
+	for _, context := range this.Contexts {
+		if _, ok := wanted[context.Name]; ok {
+			wanted[context.Name] = true
+			contexts = append(contexts, context)
+		}
+	}
+	this.Contexts = contexts
+
+	var missing []string
+	for _, name := range names {
+		if !wanted[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// Validate checks the whole config and returns every problem that it finds.
+func (this *Config) Validate() []error {
+	var errs []error
+	if this.LogFormat != "" && !isLogFormat(this.LogFormat) {
+		errs = append(errs, fmt.Errorf("log_format %q must be text or json", this.LogFormat))
+	}
+	if this.LogLevel != "" && !isLogLevel(this.LogLevel) {
+		errs = append(errs, fmt.Errorf("log_level %q must be debug, info, warning or error", this.LogLevel))
+	}
+	if this.LogMaxSizeMB < 0 {
+		errs = append(errs, fmt.Errorf("log_max_size_mb %d can't be negative", this.LogMaxSizeMB))
+	}
+	if this.LogMaxBackups != nil && *this.LogMaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("log_max_backups %d can't be negative", *this.LogMaxBackups))
+	}
+	if this.StopAfter.Duration < 0 {
+		errs = append(errs, fmt.Errorf("stop_after %s can't be negative", this.StopAfter.Duration))
+	}
+	localPorts := make(map[string]string)
+	names := make(map[string]string)
+	for i, context := range this.Contexts {
+		contextWhere := fmt.Sprintf("context %q", context.Name)
+		if context.Name == "" {
+			contextWhere = fmt.Sprintf("context #%d", i+1)
+			errs = append(errs, fmt.Errorf("%s: name is required", contextWhere))
+		}
+		switch context.Protocol {
+		case ProtocolSPDY, ProtocolWebSocket, ProtocolAuto:
+		default:
+			errs = append(errs, fmt.Errorf("%s: protocol %q must be %s, %s or %s", contextWhere, context.Protocol, ProtocolSPDY, ProtocolWebSocket, ProtocolAuto))
+		}
+		if context.QPS < 0 {
+			errs = append(errs, fmt.Errorf("%s: qps %g can't be negative", contextWhere, context.QPS))
+		}
+		if context.Burst < 0 {
+			errs = append(errs, fmt.Errorf("%s: burst %d can't be negative", contextWhere, context.Burst))
+		}
+		if context.Kubeconfig != "" {
+			if _, err := os.Stat(context.Kubeconfig); err != nil {
+				errs = append(errs, fmt.Errorf("%s: kubeconfig %s", contextWhere, err.Error()))
+			}
+			if context.InCluster {
+				errs = append(errs, fmt.Errorf("%s: kubeconfig can't be used with in_cluster", contextWhere))
+			}
+		}
+		if context.Server != "" {
+			if u, err := url.Parse(context.Server); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("%s: server %q must be an http or https URL", contextWhere, context.Server))
+			}
+			if context.Kubeconfig != "" || context.InCluster {
+				errs = append(errs, fmt.Errorf("%s: server can't be used with kubeconfig or in_cluster", contextWhere))
+			}
+			if context.Token != "" && context.TokenFile != "" {
+				errs = append(errs, fmt.Errorf("%s: use either token or token_file, not both", contextWhere))
+			}
+			if context.TokenFile != "" {
+				if _, err := os.Stat(context.TokenFile); err != nil {
+					errs = append(errs, fmt.Errorf("%s: token_file %s", contextWhere, err.Error()))
+				}
+			}
+			if context.CAFile != "" {
+				if _, err := os.Stat(context.CAFile); err != nil {
+					errs = append(errs, fmt.Errorf("%s: ca_file %s", contextWhere, err.Error()))
+				}
+				if context.Insecure {
+					errs = append(errs, fmt.Errorf("%s: use either ca_file or insecure_skip_tls_verify, not both", contextWhere))
+				}
+			}
+		} else if context.Token != "" || context.TokenFile != "" || context.CAFile != "" || context.Insecure {
+			errs = append(errs, fmt.Errorf("%s: token, token_file, ca_file and insecure_skip_tls_verify require server", contextWhere))
+		}
+		if len(context.ImpersonateGroups) > 0 && context.ImpersonateUser == "" {
+			errs = append(errs, fmt.Errorf("%s: impersonate_groups requires impersonate_user", contextWhere))
+		}
+		if context.ProxyURL != "" {
+			if u, err := url.Parse(context.ProxyURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("%s: proxy_url %q must be an http or https URL", contextWhere, redactURL(context.ProxyURL)))
+			}
+		}
+		for j, tunnel := range context.Tunnels {
+			where := fmt.Sprintf("%s tunnel #%d", contextWhere, j+1)
+			if tunnel.Name != "" {
+				where = fmt.Sprintf("%s tunnel %q", contextWhere, tunnel.Name)
+				if _, err := strconv.Atoi(tunnel.Name); err == nil || strings.ContainsAny(tunnel.Name, " \t") {
+					errs = append(errs, fmt.Errorf("%s: name can't be a number or contain spaces", where))
+				}
+				if other, ok := names[tunnel.Name]; ok {
+					errs = append(errs, fmt.Errorf("%s: name is already used by %s", where, other))
+				} else {
+					names[tunnel.Name] = fmt.Sprintf("%s tunnel #%d", contextWhere, j+1)
+				}
+			}
+			if tunnel.Namespace == "" {
+				errs = append(errs, fmt.Errorf("%s: namespace is not set", where))
+			}
+			if tunnel.Pod != "" {
+				if len(tunnel.Selector) > 0 || tunnel.FieldSelector != "" || tunnel.Service != "" || tunnel.Resource != "" || len(tunnel.Failover) > 0 {
+					errs = append(errs, fmt.Errorf("%s: pod can't be combined with selector, field_selector, service, resource or failover", where))
+				}
+			} else if len(tunnel.Selector) == 0 && tunnel.FieldSelector == "" && tunnel.Service == "" && tunnel.Resource == "" {
+				errs = append(errs, fmt.Errorf("%s: one of pod, selector, field_selector, service or resource is required", where))
+			} else if len(tunnel.Selector) > 0 && tunnel.Service != "" {
+				errs = append(errs, fmt.Errorf("%s: selector and service can't both be set", where))
+			} else if tunnel.Resource != "" && (len(tunnel.Selector) > 0 || tunnel.Service != "") {
+				errs = append(errs, fmt.Errorf("%s: resource can't be combined with selector or service", where))
+			}
+			if tunnel.Resource != "" {
+				if _, _, err := parseResource(tunnel.Resource); err != nil {
+					errs = append(errs, fmt.Errorf("%s: resource %q: %s", where, tunnel.Resource, err.Error()))
+				}
+			}
+			for _, selector := range tunnel.Failover {
+				if _, err := labels.Parse(selector); err != nil {
+					errs = append(errs, fmt.Errorf("%s: failover %q: %s", where, selector, err.Error()))
+				} else if selector == "" {
+					errs = append(errs, fmt.Errorf("%s: failover selectors can't be empty", where))
+				}
+			}
+			for _, selector := range tunnel.Selector {
+				if _, err := labels.Parse(selector); err != nil {
+					errs = append(errs, fmt.Errorf("%s: selector %q: %s", where, selector, err.Error()))
+				} else if selector == "" {
+					errs = append(errs, fmt.Errorf("%s: selector can't be empty", where))
+				}
+			}
+			if tunnel.Socks {
+				if tunnel.PodPort != (NamedPort{}) || len(tunnel.Ports) > 0 {
+					errs = append(errs, fmt.Errorf("%s: pod_port and ports can't be used with socks", where))
+				}
+				if tunnel.LocalPort < 0 || tunnel.LocalPort > 65535 {
+					errs = append(errs, fmt.Errorf("%s: local_port %d is not in the range 1-65535 (or \"auto\" to pick a free port)", where, tunnel.LocalPort))
+				}
+			} else if tunnel.PodPort != (NamedPort{}) || len(tunnel.Ports) == 0 {
+				if tunnel.PodPort.Name == "" && (tunnel.PodPort.Number < 1 || tunnel.PodPort.Number > 65535) {
+					errs = append(errs, fmt.Errorf("%s: pod_port %d is not in the range 1-65535", where, tunnel.PodPort.Number))
+				}
+				if tunnel.LocalPort < 0 || tunnel.LocalPort > 65535 {
+					errs = append(errs, fmt.Errorf("%s: local_port %d is not in the range 1-65535 (or \"auto\" to pick a free port)", where, tunnel.LocalPort))
+				}
+			}
+			for _, mapping := range tunnel.Ports {
+				if mapping.Pod.Name == "" && (mapping.Pod.Number < 1 || mapping.Pod.Number > 65535) {
+					errs = append(errs, fmt.Errorf("%s: ports %q: pod port %d is not in the range 1-65535", where, mapping, mapping.Pod.Number))
+				}
+				if mapping.Local < 0 || mapping.Local > 65535 {
+					errs = append(errs, fmt.Errorf("%s: ports %q: local port %d is not in the range 1-65535 (or \"auto\" to pick a free port)", where, mapping, mapping.Local))
+				}
+			}
+			switch strings.ToLower(tunnel.Protocol) {
+			case "", PortProtocolTCP:
+			case PortProtocolUDP:
+				errs = append(errs, fmt.Errorf("%s: protocol %s isn't supported: %s", where, tunnel.Protocol, errUDP))
+			default:
+				errs = append(errs, fmt.Errorf("%s: protocol %q must be %s (the port-forward protocol is set on the context)", where, tunnel.Protocol, PortProtocolTCP))
+			}
+			for _, mapping := range tunnel.PortMappings() {
+				if strings.HasSuffix(strings.ToLower(mapping.Pod.Name), "/"+PortProtocolUDP) {
+					errs = append(errs, fmt.Errorf("%s: pod port %s isn't supported: %s", where, mapping.Pod, errUDP))
+				}
+			}
+			var ownPorts []string
+			seen := make(map[string]bool)
+			for _, mapping := range tunnel.PortMappings() {
+				if mapping.Local == 0 {
+					continue
+				}
+				for _, address := range tunnel.BindAddresses(mapping) {
+					key := net.JoinHostPort(address, strconv.Itoa(mapping.Local))
+					if seen[key] {
+						errs = append(errs, fmt.Errorf("%s: local port %s is used more than once", where, key))
+						continue
+					}
+					seen[key] = true
+					ownPorts = append(ownPorts, key)
+				}
+			}
+			durations := []struct {
+				key   string
+				value Duration
+			}{
+				{"reconnect_interval", tunnel.ReconnectInterval},
+				{"min_backoff", tunnel.MinBackoff},
+				{"max_backoff", tunnel.MaxBackoff},
+				{"ready_timeout", tunnel.ReadyTimeout},
+				{"discovery_timeout", tunnel.DiscoveryTimeout},
+				{"dial_timeout", tunnel.DialTimeout},
+				{"discovery_retry_interval", tunnel.DiscoveryRetryInterval},
+				{"idle_timeout", tunnel.IdleTimeout},
+				{"max_lifetime", tunnel.MaxLifetime},
+				{"tcp_keepalive", tunnel.TCPKeepalive},
+				{"io_timeout", tunnel.IOTimeout},
+				{"drain_timeout", tunnel.DrainTimeout},
+				{"startup_jitter", tunnel.StartupJitter},
+			}
+			for _, d := range durations {
+				if d.value.Duration < 0 {
+					errs = append(errs, fmt.Errorf("%s: %s %s can't be negative", where, d.key, d.value.Duration))
+				}
+			}
+			if tunnel.MaxReconnects < 0 {
+				errs = append(errs, fmt.Errorf("%s: max_reconnects %d can't be negative", where, tunnel.MaxReconnects))
+			}
+			if tunnel.MaxConnections < 0 {
+				errs = append(errs, fmt.Errorf("%s: max_connections %d can't be negative", where, tunnel.MaxConnections))
+			}
+			if tunnel.MaxConnectionsAction != "" && tunnel.MaxConnectionsAction != LimitQueue && tunnel.MaxConnectionsAction != LimitReject {
+				errs = append(errs, fmt.Errorf("%s: max_connections_action %q must be %s or %s", where, tunnel.MaxConnectionsAction, LimitQueue, LimitReject))
+			}
+			if tunnel.Mode != "" && tunnel.Mode != ModeFirst && tunnel.Mode != ModeRoundRobin && tunnel.Mode != ModeFanout {
+				errs = append(errs, fmt.Errorf("%s: mode %q must be %s, %s or %s", where, tunnel.Mode, ModeFirst, ModeRoundRobin, ModeFanout))
+			}
+			if tunnel.Mode == ModeFanout {
+				if err := checkPort(int64(tunnel.LocalPortBase)); err != nil {
+					errs = append(errs, fmt.Errorf("%s: mode %s needs local_port_base: %s", where, ModeFanout, err.Error()))
+				} else if tunnel.LocalPortBase == 65535 {
+					errs = append(errs, fmt.Errorf("%s: local_port_base %d leaves room for only one pod, it must be at most 65534", where, tunnel.LocalPortBase))
+				}
+				if tunnel.Pod != "" || tunnel.Service != "" || len(tunnel.Failover) > 0 || len(tunnel.Ports) > 0 || tunnel.Socks || tunnel.Sticky || tunnel.Select != "" || tunnel.Once {
+					errs = append(errs, fmt.Errorf("%s: mode %s can't be used with pod, service, failover, ports, socks, sticky, select or once", where, ModeFanout))
+				}
+			} else if tunnel.LocalPortBase != 0 {
+				errs = append(errs, fmt.Errorf("%s: local_port_base can only be used with mode %s", where, ModeFanout))
+			}
+			if tunnel.Namespace == AllNamespaces && (tunnel.Pod != "" || tunnel.Service != "" || tunnel.Resource != "" || tunnel.Mode == ModeRoundRobin || tunnel.Mode == ModeFanout) {
+				errs = append(errs, fmt.Errorf("%s: namespace %q can't be used with pod, service, resource, or mode %s or %s", where, AllNamespaces, ModeRoundRobin, ModeFanout))
+			}
+			if tunnel.Select != "" && tunnel.Select != SelectNewest && tunnel.Select != SelectOldest {
+				errs = append(errs, fmt.Errorf("%s: select %q must be %s or %s", where, tunnel.Select, SelectNewest, SelectOldest))
+			} else if tunnel.Select != "" && tunnel.Mode == ModeRoundRobin {
+				errs = append(errs, fmt.Errorf("%s: select can't be used with mode %s", where, ModeRoundRobin))
+			}
+			if tunnel.TLS != nil {
+				if (tunnel.TLS.CertFile == "") != (tunnel.TLS.KeyFile == "") {
+					errs = append(errs, fmt.Errorf("%s: tls needs both cert_file and key_file, or neither for a self-signed certificate", where))
+				} else if tunnel.TLS.CertFile != "" {
+					if _, err := tls.LoadX509KeyPair(tunnel.TLS.CertFile, tunnel.TLS.KeyFile); err != nil {
+						errs = append(errs, fmt.Errorf("%s: tls: %s", where, err.Error()))
+					}
+				}
+				if tunnel.Socks {
+					errs = append(errs, fmt.Errorf("%s: tls can't be used with socks", where))
+				}
+			}
+			if tunnel.Sticky && tunnel.Mode == ModeRoundRobin {
+				errs = append(errs, fmt.Errorf("%s: sticky can't be used with mode %s", where, ModeRoundRobin))
+			}
+			if tunnel.MinBackoff.Duration > tunnel.MaxBackoff.Duration {
+				errs = append(errs, fmt.Errorf("%s: min_backoff %s is greater than max_backoff %s", where, tunnel.MinBackoff.Duration, tunnel.MaxBackoff.Duration))
+			}
+			for _, address := range tunnel.BindAddress {
+				if net.ParseIP(address) == nil {
+					errs = append(errs, fmt.Errorf("%s: bind_address %q is not a valid IP", where, address))
+				}
+			}
+			for _, key := range ownPorts {
+				if other, ok := localPorts[key]; ok {
+					errs = append(errs, fmt.Errorf("%s: local port %s is already used by %s", where, key, other))
+				} else {
+					localPorts[key] = where
+				}
+			}
+		}
+	}
+	return errs
+}
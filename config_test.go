@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInheritDefaults(t *testing.T) {
+	configs := []struct {
+		format string
+		data   string
+	}{
+		{FormatTOML, `
+[default]
+name = "shared"
+pod_port = 9090
+wait_for_ready = true
+dial_timeout = "5s"
+idle_timeout = "1m"
+
+[[context]]
+name = "prod"
+[context.default]
+idle_timeout = "2m"
+[[context.tunnel]]
+selector = "app=api"
+pod_port = 8080
+[[context.tunnel]]
+selector = "app=web"
+wait_for_ready = false
+idle_timeout = "0s"
+`},
+		{FormatYAML, `
+default:
+  name: shared
+  pod_port: 9090
+  wait_for_ready: true
+  dial_timeout: 5s
+  idle_timeout: 1m
+context:
+- name: prod
+  default:
+    idle_timeout: 2m
+  tunnel:
+  - selector: app=api
+    pod_port: 8080
+  - selector: app=web
+    wait_for_ready: false
+    idle_timeout: 0s
+`},
+	}
+	for _, c := range configs {
+		config, err := DecodeConfig("test", c.format, []byte(c.data))
+		if err != nil {
+			t.Fatalf("%s: %s", c.format, err.Error())
+		}
+		config.SetDefaults()
+		api, web := config.Contexts[0].Tunnels[0], config.Contexts[0].Tunnels[1]
+		if !api.WaitForReady || api.DialTimeout.Duration != 5*time.Second || api.IdleTimeout.Duration != 2*time.Minute {
+			t.Errorf("%s: app=api got wait_for_ready %t, dial_timeout %s and idle_timeout %s, want the defaults", c.format, api.WaitForReady, api.DialTimeout.Duration, api.IdleTimeout.Duration)
+		}
+		if api.Name != "" || api.PodPort.Number != 8080 {
+			t.Errorf("%s: app=api got name %q and pod_port %s, want them not to be inherited", c.format, api.Name, api.PodPort)
+		}
+		if web.WaitForReady || web.IdleTimeout.Duration != 0 {
+			t.Errorf("%s: app=web got wait_for_ready %t and idle_timeout %s, want its own false and 0s", c.format, web.WaitForReady, web.IdleTimeout.Duration)
+		}
+		if web.PodPort.Number != 0 {
+			t.Errorf("%s: app=web got pod_port %s, want it not to be inherited", c.format, web.PodPort)
+		}
+	}
+}
+
+func TestValidateUDP(t *testing.T) {
+	config, err := DecodeConfig("test", FormatTOML, []byte(`
+[[context]]
+name = "prod"
+[[context.tunnel]]
+namespace = "kube-system"
+selector = "k8s-app=kube-dns"
+pod_port = 53
+protocol = "udp"
+`))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	config.SetDefaults()
+	errs := config.Validate()
+	want := `context "prod" tunnel #1: protocol udp isn't supported: ` + errUDP
+	if len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("got errors %q, want %q", errs, want)
+	}
+}
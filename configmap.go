@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// configMapRetryInterval is how long to wait before watching a ConfigMap
+// again after the watch failed.
+const configMapRetryInterval = 5 * time.Second
+
+// isConfigMap returns true if path is a configmap://namespace/name/key URL
+// rather than a file.
+func isConfigMap(path string) bool {
+	return strings.HasPrefix(path, "configmap://")
+}
+
+// configMapSource is a key of a ConfigMap that the config is read from.
+// Context is the kubeconfig context to read it with, from ?context=. Without
+// it, the pod's service account is used in-cluster, and the current context
+// otherwise.
+type configMapSource struct {
+	Namespace string
+	Name      string
+	Key       string
+	Context   string
+}
+
+func (this configMapSource) String() string {
+	return fmt.Sprintf("ConfigMap %s/%s", this.Namespace, this.Name)
+}
+
+// parseConfigMap parses a configmap://namespace/name/key URL.
+func parseConfigMap(path string) (configMapSource, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return configMapSource{}, err
+	}
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if u.Host == "" || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return configMapSource{}, fmt.Errorf("%s must be like configmap://namespace/name/key", path)
+	}
+	return configMapSource{
+		Namespace: u.Host,
+		Name:      parts[0],
+		Key:       parts[1],
+		Context:   u.Query().Get("context"),
+	}, nil
+}
+
+// client connects to the cluster that the ConfigMap is in.
+func (this configMapSource) client() (*kubernetes.Clientset, error) {
+	var cfg *rest.Config
+	var err error
+	if this.Context == "" {
+		cfg, err = rest.InClusterConfig()
+	}
+	if this.Context != "" || err == rest.ErrNotInCluster {
+		cfg, err = clientConfig(Context{Name: this.Context}).ClientConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(cfg)
+}
+
+// data returns the config from the ConfigMap.
+func (this configMapSource) data(configMap *v1.ConfigMap) ([]byte, error) {
+	data, ok := configMap.Data[this.Key]
+	if !ok {
+		return nil, fmt.Errorf("%s has no key %s", this, this.Key)
+	}
+	return []byte(data), nil
+}
+
+// readConfigMap reads the config from a configmap://namespace/name/key URL.
+func readConfigMap(path string) ([]byte, error) {
+	source, err := parseConfigMap(path)
+	if err != nil {
+		return nil, err
+	}
+	clientSet, err := source.client()
+	if err != nil {
+		return nil, err
+	}
+	configMap, err := clientSet.CoreV1().ConfigMaps(source.Namespace).Get(source.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return source.data(configMap)
+}
+
+// watchConfigMap calls changed in the background whenever the config in the
+// ConfigMap at path changes. The watch is started again when the API server
+// closes it, and changes that were made in the meantime are picked up then.
+func watchConfigMap(path string, changed func()) error {
+	source, err := parseConfigMap(path)
+	if err != nil {
+		return err
+	}
+	clientSet, err := source.client()
+	if err != nil {
+		return err
+	}
+	configMaps := clientSet.CoreV1().ConfigMaps(source.Namespace)
+	configMap, err := configMaps.Get(source.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	last, _ := source.data(configMap)
+	go func() {
+		for {
+			// Without a resourceVersion, the watch starts with the current
+			// ConfigMap.
+			watcher, err := configMaps.Watch(metav1.ListOptions{
+				FieldSelector: fields.OneTermEqualSelector("metadata.name", source.Name).String(),
+			})
+			if err != nil {
+				Log{}.Warnf("Watching %s: %s", source, err.Error())
+				time.Sleep(configMapRetryInterval)
+				continue
+			}
+			for event := range watcher.ResultChan() {
+				if event.Type == watch.Error {
+					Log{}.Warnf("Watching %s: %s", source, k8serrors.FromObject(event.Object).Error())
+					break
+				}
+				configMap, ok := event.Object.(*v1.ConfigMap)
+				if !ok {
+					continue
+				}
+				if event.Type == watch.Deleted {
+					Log{}.Warnf("%s was deleted, keeping the current tunnels.", source)
+					continue
+				}
+				// A missing key is reloaded too, so that the error is
+				// logged.
+				data, _ := source.data(configMap)
+				if string(data) == string(last) {
+					continue
+				}
+				last = data
+				changed()
+			}
+			watcher.Stop()
+			time.Sleep(configMapRetryInterval)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// restartTimeout is how long restart waits for the tunnel to become ready.
+const restartTimeout = 60 * time.Second
+
+// controlResponse is written as one JSON line for every command.
+type controlResponse struct {
+	OK      bool          `json:"ok"`
+	Error   string        `json:"error,omitempty"`
+	Tunnels []TunnelState `json:"tunnels,omitempty"`
+}
+
+// StartControlServer listens on the Unix socket at path in the background.
+// Every line received is a command, and it is answered with a JSON line:
+//
+//	list        lists the tunnels with their id, name, context, selector, pod,
+//	            local port, state, connects and when they came up
+//	stop <id>   stops the tunnel
+//	start <id>  starts the tunnel again
+//	restart <id>
+//	            stops the tunnel if it is running and starts it again, and
+//	            answers with its new pod and local port once it is ready
+//
+// Tunnels can be given by their id, name or key. Only the current user may
+// connect to the socket.
+func StartControlServer(path string, proxy *Proxy) (net.Listener, error) {
+	// Remove the socket left behind by a previous run that didn't exit
+	// cleanly, but nothing else.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	go func() {
+		Log{}.Infof("Serving the control socket on %s.", path)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveControl(conn, proxy)
+		}
+	}()
+	return listener, nil
+}
+
+func serveControl(conn net.Conn, proxy *Proxy) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	encoder.SetEscapeHTML(false)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		var response controlResponse
+		var err error
+		switch {
+		case fields[0] == "":
+			continue
+		case fields[0] == "list" && len(fields) == 1:
+			response.Tunnels = proxy.States()
+		case fields[0] == "stop" && len(fields) == 2:
+			err = proxy.Stop(strings.TrimSpace(fields[1]))
+		case fields[0] == "start" && len(fields) == 2:
+			err = proxy.Start(strings.TrimSpace(fields[1]))
+		case fields[0] == "restart" && len(fields) == 2:
+			var state TunnelState
+			state, err = proxy.Restart(strings.TrimSpace(fields[1]), restartTimeout)
+			if state.Key != "" {
+				response.Tunnels = []TunnelState{state}
+			}
+		default:
+			response.Error = "Unknown command, expected list, stop <id>, start <id> or restart <id>"
+		}
+		if err != nil {
+			response.Error = err.Error()
+		}
+		response.OK = response.Error == ""
+		if encoder.Encode(response) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	gocontext "context"
+	"strconv"
+	"strings"
+)
+
+// DryRun lists the pods that each tunnel's selector matches and the port
+// mapping it would use, without forwarding anything. It returns the number
+// of tunnels that couldn't be resolved.
+func DryRun(config Config) int {
+	failed := 0
+	for _, context := range config.Contexts {
+		log := Log{Context: context.Name}
+		_, clientSet, err := NewClient(context)
+		if err != nil {
+			log.Errorf("%s. Skipping %d tunnels.", err.Error(), len(context.Tunnels))
+			failed += len(context.Tunnels)
+			continue
+		}
+
+		for _, tunnel := range context.Tunnels {
+			log := Log{Context: context.Name, Tunnel: tunnel.Target(), Name: tunnel.Name, LocalPort: tunnel.PortMappings()[0].Local}
+			selectors, service, err := resolveSelector(gocontext.Background(), clientSet, tunnel)
+			if err != nil {
+				log.Errorf("%s", err.Error())
+				failed++
+				continue
+			}
+			pods, err := listSelectorPods(gocontext.Background(), clientSet, tunnel, selectors)
+			if err != nil {
+				log.Errorf("%s", err.Error())
+				failed++
+				continue
+			}
+			description := describeSelectors(selectors, tunnel.FieldSelector)
+			if tunnel.Pod != "" {
+				description = tunnel.Target()
+			}
+			if len(pods) < 1 {
+				log.Errorf("No pods found in namespace %s: %s.", tunnel.Namespace, description)
+				failed++
+				continue
+			}
+
+			log.Infof("Found %d pods in namespace %s: %s", len(pods), tunnel.Namespace, description)
+			for _, pod := range pods {
+				ready := "ready"
+				if reason := podNotReadyReason(&pod); reason != "" {
+					ready = "not ready: " + reason
+				}
+				var mappings []string
+				for _, mapping := range tunnel.PortMappings() {
+					localPort := "auto"
+					if mapping.Local != 0 {
+						localPort = strconv.Itoa(mapping.Local)
+					}
+					if tunnel.Socks {
+						mappings = append(mappings, joinAddresses(tunnel.BindAddresses(mapping), localPort)+" -> SOCKS through the pod")
+						continue
+					}
+					var podPort int
+					if service != nil {
+						podPort, err = servicePodPort(service, &pod, mapping.Pod)
+					} else {
+						podPort, err = podPortNumber(&pod, mapping.Pod)
+					}
+					if err != nil {
+						mappings = append(mappings, err.Error())
+					} else if !containerPortDeclared(&pod, podPort) {
+						mappings = append(mappings, joinAddresses(tunnel.BindAddresses(mapping), localPort)+" -> "+strconv.Itoa(podPort)+" (not declared by the pod)")
+					} else {
+						mappings = append(mappings, joinAddresses(tunnel.BindAddresses(mapping), localPort)+" -> "+strconv.Itoa(podPort))
+					}
+				}
+				mapping := strings.Join(mappings, ", ")
+				log.WithPod(pod.Name).Infof("- %s (phase %s, node %s, %s): %s", pod.Name, pod.Status.Phase, pod.Spec.NodeName, ready, mapping)
+			}
+		}
+	}
+	return failed
+}
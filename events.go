@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// TunnelEvent is sent to the subscribers of /events whenever a tunnel's
+// state changes. State is the same as in the SIGUSR1 table.
+type TunnelEvent struct {
+	Tunnel      string `json:"tunnel"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	ID          int    `json:"id"`
+	Context     string `json:"context"`
+	State       string `json:"state"`
+	Pod         string `json:"pod,omitempty"`
+	LocalPorts  string `json:"local_port"`
+	Reconnects  int    `json:"reconnects"`
+	// Time is in milliseconds since the Unix epoch.
+	Time int64 `json:"ts"`
+}
+
+func newTunnelEvent(state TunnelState) TunnelEvent {
+	status, reconnects := describeState(state)
+	return TunnelEvent{
+		Tunnel:      state.Key,
+		Name:        state.Name,
+		Description: state.Description,
+		ID:          state.ID,
+		Context:     state.Context,
+		State:       status,
+		Pod:         state.Pod,
+		LocalPorts:  state.LocalPorts,
+		Reconnects:  reconnects,
+		Time:        time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// How many events a subscriber can fall behind before it misses some, and
+// how often idle streams get a comment so that proxies keep them open.
+const (
+	eventBuffer       = 64
+	eventPingInterval = 30 * time.Second
+)
+
+// Subscribe returns a channel that gets an event whenever a tunnel's state
+// changes, and a function to unsubscribe.
+func (this *Proxy) Subscribe() (<-chan TunnelEvent, func()) {
+	events := make(chan TunnelEvent, eventBuffer)
+	this.eventMutex.Lock()
+	this.subscribers[events] = true
+	this.eventMutex.Unlock()
+	return events, func() {
+		this.eventMutex.Lock()
+		delete(this.subscribers, events)
+		this.eventMutex.Unlock()
+	}
+}
+
+// changed sends an event for the tunnel to the subscribers, unless it is in
+// the same state as last time. It must be called without holding mutex.
+func (this *Proxy) changed(key string) {
+	event := newTunnelEvent(this.state(key))
+	this.eventMutex.Lock()
+	defer this.eventMutex.Unlock()
+	last, ok := this.lastEvents[key]
+	if ok && last.State == event.State && last.Pod == event.Pod {
+		return
+	}
+	this.lastEvents[key] = event
+	for events := range this.subscribers {
+		select {
+		case events <- event:
+		default:
+			// Slow subscribers miss events rather than holding up the
+			// tunnels.
+		}
+	}
+}
+
+// serveEvents streams the tunnels' events as server-sent events, starting
+// with the current state of every tunnel.
+func serveEvents(proxy *Proxy, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events, unsubscribe := proxy.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	send := func(event TunnelEvent) bool {
+		data, _ := json.Marshal(event)
+		_, err := fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+		return err == nil
+	}
+	for _, state := range proxy.States() {
+		if !send(newTunnelEvent(state)) {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(eventPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-proxy.ctx.Done():
+			return
+		case event := <-events:
+			if !send(event) {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// fanoutChild is the tunnel to one of the pods of a fanout tunnel.
+type fanoutChild struct {
+	port   int
+	cancel gocontext.CancelFunc
+	done   chan struct{}
+	up     bool
+}
+
+// Fanout forwards to every pod matching the tunnel's selector, each on its own
+// local port counting up from local_port_base, until ctx is cancelled. The
+// pods are looked up again every reconnect_interval. New pods get the lowest
+// free port, so that the ports of pods that are gone are reused. setUp is
+// called like for PortForward, with all of the pods and ports, and the tunnel
+// is up while all of its pods are.
+func Fanout(ctx gocontext.Context, cfg *rest.Config, clientSet kubernetes.Interface, context string, protocol string, proxyURL string, tunnel Tunnel, setUp func(up bool, pod string, ports string)) error {
+	log := Log{Context: context, Namespace: tunnel.Namespace, Tunnel: tunnel.Target(), Name: tunnel.Name}
+	log.Infof("Using fanout mode, forwarding to every pod on the ports from %d.", tunnel.LocalPortBase)
+
+	var mutex sync.Mutex
+	children := make(map[string]*fanoutChild)
+	// skipped has the pods that didn't get a port, so that it's only logged
+	// once.
+	skipped := make(map[string]bool)
+	var last string
+	// report passes the state of the pods on to setUp when it changes.
+	report := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		names := sortedByPort(children)
+		up := len(names) > 0
+		var ports []string
+		for _, name := range names {
+			up = up && children[name].up
+			ports = append(ports, strconv.Itoa(children[name].port))
+		}
+		state := fmt.Sprintf("%t %s %s", up, strings.Join(names, ","), strings.Join(ports, ","))
+		if state == last {
+			return
+		}
+		last = state
+		if up {
+			setUp(true, strings.Join(names, ","), strings.Join(ports, ","))
+		} else {
+			setUp(false, "", "")
+		}
+	}
+	stopAll := func() {
+		mutex.Lock()
+		var running []*fanoutChild
+		for _, child := range children {
+			child.cancel()
+			running = append(running, child)
+		}
+		mutex.Unlock()
+		for _, child := range running {
+			<-child.done
+		}
+	}
+
+	start := func(podName string, port int) {
+		childTunnel := fanoutTunnel(tunnel, podName, port)
+		childCtx, cancel := gocontext.WithCancel(ctx)
+		child := &fanoutChild{
+			port:   port,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		children[podName] = child
+		go func() {
+			defer close(child.done)
+			PortForward(childCtx, cfg, clientSet, context, protocol, proxyURL, childTunnel, func(up bool, pod string, ports string) {
+				mutex.Lock()
+				child.up = up
+				mutex.Unlock()
+				report()
+			})
+			mutex.Lock()
+			child.up = false
+			mutex.Unlock()
+			report()
+		}()
+	}
+
+	if !waitStartupJitter(log, tunnel, ctx.Done()) {
+		return nil
+	}
+	ticker := time.NewTicker(tunnel.ReconnectInterval.Duration)
+	defer ticker.Stop()
+	for attempt := 0; ; attempt++ {
+		pods, err := fanoutPods(ctx, clientSet, log, tunnel)
+		if err != nil && ctx.Err() == nil {
+			if isAuthError(err) {
+				err = credentialsError(context, err)
+			}
+			if attempt == 0 && !tunnel.WaitForPod && (isPermanent(err) || isAuthError(err)) {
+				log.Errorf("Giving up on %s: %s", tunnel.Target(), err.Error())
+				return err
+			}
+			log.Errorf("Could not look up the pods: %s", err.Error())
+		} else if err == nil {
+			if len(pods) == 0 && attempt == 0 && !tunnel.WaitForPod {
+				log.Errorf("No pods found: %s.", tunnel.Target())
+				return errNoPods
+			}
+			mutex.Lock()
+			changed := false
+			var closing []*fanoutChild
+			for name, child := range children {
+				select {
+				case <-child.done:
+					// It gave up, e.g. because the pod was briefly gone.
+					delete(children, name)
+				default:
+					if !pods[name] {
+						log.Infof("Pod %s is gone, closing port %d.", name, child.port)
+						child.cancel()
+						delete(children, name)
+						closing = append(closing, child)
+						changed = true
+					}
+				}
+			}
+			// The ports of the pods that are gone can only be reused once
+			// they are closed. The children call report, which needs the
+			// mutex, until they are done.
+			mutex.Unlock()
+			for _, child := range closing {
+				<-child.done
+			}
+			mutex.Lock()
+			var added []string
+			for name := range pods {
+				if _, ok := children[name]; !ok {
+					added = append(added, name)
+				}
+			}
+			sort.Strings(added)
+			for name := range skipped {
+				if !pods[name] {
+					delete(skipped, name)
+				}
+			}
+			for _, name := range added {
+				port, ok := freeFanoutPort(children, tunnel.LocalPortBase)
+				if !ok {
+					if !skipped[name] {
+						log.Errorf("No free port left up to 65535 for pod %s, skipping it.", name)
+						skipped[name] = true
+					}
+					continue
+				}
+				delete(skipped, name)
+				start(name, port)
+				changed = true
+			}
+			if changed {
+				var mapping []string
+				for _, name := range sortedByPort(children) {
+					mapping = append(mapping, fmt.Sprintf("%s -> %s", name, joinAddresses(tunnel.BindAddresses(PortMapping{}), strconv.Itoa(children[name].port))))
+				}
+				log.Infof("Forwarding to %d pods: %s", len(mapping), strings.Join(mapping, ", "))
+			}
+			mutex.Unlock()
+			report()
+		}
+
+		select {
+		case <-ctx.Done():
+			stopAll()
+			log.Eventf("Stopped forwarding %s.", tunnel.Target())
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// fanoutPods returns the names of the running pods matching the tunnel's
+// selector, or only the ready ones with wait_for_ready.
+func fanoutPods(ctx gocontext.Context, clientSet kubernetes.Interface, log Log, tunnel Tunnel) (map[string]bool, error) {
+	release, ok := connectSlots.Acquire(ctx, log)
+	if !ok {
+		return nil, ctx.Err()
+	}
+	defer release()
+	selectors, _, err := resolveSelector(ctx, clientSet, tunnel)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := listSelectorPods(ctx, clientSet, tunnel, selectors)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		if tunnel.WaitForReady && podNotReadyReason(&pod) != "" {
+			continue
+		}
+		names[pod.Name] = true
+	}
+	return names, nil
+}
+
+// fanoutTunnel returns the tunnel to podName on port, for one of the pods of a
+// fanout tunnel.
+func fanoutTunnel(tunnel Tunnel, podName string, port int) Tunnel {
+	child := tunnel
+	child.Pod = podName
+	child.Selector, child.FieldSelector, child.Resource = nil, "", ""
+	child.Mode, child.LocalPortBase = "", 0
+	// Fanout already waited for startup_jitter.
+	child.StartupJitter = Duration{}
+	child.LocalPort = AutoPort(port)
+	// The pod can come back after a restart, and if it doesn't, Fanout
+	// closes its port.
+	child.WaitForPod = true
+	if tunnel.Name != "" {
+		child.Name = tunnel.Name + "/" + podName
+	}
+	return child
+}
+
+// freeFanoutPort returns the lowest port from base that none of the children
+// use, and false if there is none up to 65535.
+func freeFanoutPort(children map[string]*fanoutChild, base int) (int, bool) {
+	used := make(map[int]bool)
+	for _, child := range children {
+		used[child.port] = true
+	}
+	for port := base; port <= 65535; port++ {
+		if !used[port] {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// sortedByPort returns the names of the pods, ordered by their ports.
+func sortedByPort(children map[string]*fanoutChild) []string {
+	var names []string
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return children[names[i]].port < children[names[j]].port
+	})
+	return names
+}
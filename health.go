@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// StartHealthServer serves /healthz, /readyz and /events on addr in the
+// background. /readyz only returns 200 when every tunnel in the config is
+// up.
+func StartHealthServer(addr string, proxy *Proxy) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		states := proxy.States()
+		status := http.StatusOK
+		for _, state := range states {
+			if state.State != StateUp {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		for _, state := range states {
+			if state.Description != "" {
+				fmt.Fprintf(w, "%s: %s (%s)\n", state.Key, state.State, state.Description)
+			} else {
+				fmt.Fprintf(w, "%s: %s\n", state.Key, state.State)
+			}
+		}
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(proxy, w, r)
+	})
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		Log{}.Infof("Serving health checks on %s.", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			Log{}.Errorf("Health server failed: %s", err.Error())
+		}
+	}()
+	return server
+}
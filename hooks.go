@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	gocontext "context"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hookTimeout is how long on_ready and on_stop hooks may run.
+const hookTimeout = 30 * time.Second
+
+// runHook runs command with sh, passing the tunnel's details in the
+// environment. The output is logged, and errors are only logged since a
+// failing hook shouldn't affect the tunnel.
+func runHook(log Log, name string, command string, context string, tunnel Tunnel, pod string) {
+	log = log.WithPod(pod)
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), hookTimeout)
+	defer cancel()
+
+	var localPorts []string
+	for _, mapping := range tunnel.Ports {
+		localPorts = append(localPorts, strconv.Itoa(mapping.Local))
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"KUBE_TUNNEL_HOOK="+name,
+		"KUBE_TUNNEL_CONTEXT="+context,
+		"KUBE_TUNNEL_NAMESPACE="+tunnel.Namespace,
+		"KUBE_TUNNEL_TARGET="+tunnel.Target(),
+		"KUBE_TUNNEL_POD="+pod,
+		"KUBE_TUNNEL_LOCAL_PORT="+localPorts[0],
+		"KUBE_TUNNEL_LOCAL_PORTS="+strings.Join(localPorts, ","),
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Errorf("Could not run %s hook: %s", name, err.Error())
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		log.Errorf("Could not run %s hook: %s", name, err.Error())
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		log.Errorf("Could not run %s hook: %s", name, err.Error())
+		return
+	}
+
+	var wg sync.WaitGroup
+	logLines := func(r io.Reader) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			log.Infof("%s: %s", name, scanner.Text())
+		}
+	}
+	wg.Add(2)
+	go logLines(stdout)
+	go logLines(stderr)
+	wg.Wait()
+
+	if err := cmd.Wait(); err != nil {
+		log.Errorf("%s hook failed: %s", name, err.Error())
+	}
+}
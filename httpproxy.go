@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	spdystream "k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/client-go/rest"
+)
+
+// proxyFunc returns the proxy to use for a request: proxyURL if it is set,
+// and otherwise the one from $HTTPS_PROXY, $HTTP_PROXY and $NO_PROXY.
+func proxyFunc(proxyURL string) func(*http.Request) (*url.URL, error) {
+	if proxyURL == "" {
+		return utilnet.NewProxierWithNoProxyCIDR(http.ProxyFromEnvironment)
+	}
+	u, err := url.Parse(proxyURL)
+	return func(*http.Request) (*url.URL, error) {
+		return u, err
+	}
+}
+
+// redactURL hides the password in rawURL, for log messages.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// withProxy makes the API calls use proxyURL, by replacing the proxy of
+// client-go's transport.
+func withProxy(cfg *rest.Config, proxyURL string) {
+	proxy := proxyFunc(proxyURL)
+	wrap := cfg.WrapTransport
+	cfg.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if transport, ok := rt.(*http.Transport); ok {
+			transport = transport.Clone()
+			transport.Proxy = proxy
+			rt = transport
+		}
+		if wrap != nil {
+			rt = wrap(rt)
+		}
+		return rt
+	}
+}
+
+// dialThrough connects to address, with a CONNECT through proxy if it is not
+// nil, and then does the TLS handshake if tlsConfig is not nil.
+func dialThrough(proxy *url.URL, address string, tlsConfig *tls.Config, timeout time.Duration, keepAlive time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: keepAlive}
+	if proxy == nil {
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return clientTLS(conn, address, tlsConfig, timeout)
+	}
+
+	proxyAddress := canonicalAddress(proxy)
+	conn, err := dialer.Dial("tcp", proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to the proxy %s: %s", proxy.Host, err.Error())
+	}
+	if proxy.Scheme == "https" {
+		conn, err = clientTLS(conn, proxyAddress, &tls.Config{}, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Could not connect to the proxy %s: %s", proxy.Host, err.Error())
+		}
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		// User.String() is escaped for the URL, e.g. p%40ss.
+		password, _ := proxy.User.Password()
+		credentials := proxy.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("The proxy %s responded with %s", proxy.Host, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return clientTLS(&bufferedConn{Conn: conn, reader: reader}, address, tlsConfig, timeout)
+}
+
+// bufferedConn reads what is left in reader before reading from the
+// connection, for connections that a response was read from with a
+// bufio.Reader, which can read past the end of the response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (this *bufferedConn) Read(b []byte) (int, error) {
+	return this.reader.Read(b)
+}
+
+func clientTLS(conn net.Conn, address string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if tlsConfig == nil {
+		return conn, nil
+	}
+	if tlsConfig.ServerName == "" {
+		host, _, _ := net.SplitHostPort(address)
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// canonicalAddress returns the host:port of u, with the default port for its
+// scheme if it has none.
+func canonicalAddress(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// proxyUpgrader is used instead of client-go's SPDY round tripper when the
+// context has a proxy_url, since client-go only uses the proxy from the
+// environment for SPDY.
+type proxyUpgrader struct {
+	proxy     *url.URL
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	keepAlive time.Duration
+	// conns holds the connection of every response from RoundTrip until
+	// NewConnection takes it, since the upgrader is shared by the sessions
+	// and SOCKS connections of a tunnel.
+	mutex sync.Mutex
+	conns map[*http.Response]net.Conn
+}
+
+func newProxyUpgrader(cfg *rest.Config, proxyURL string, timeout time.Duration, keepAlive time.Duration) (*proxyUpgrader, error) {
+	proxy, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := rest.TLSConfigFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	return &proxyUpgrader{
+		proxy:     proxy,
+		tlsConfig: tlsConfig,
+		timeout:   timeout,
+		keepAlive: keepAlive,
+		conns:     make(map[*http.Response]net.Conn),
+	}, nil
+}
+
+func (this *proxyUpgrader) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = utilnet.CloneRequest(req)
+	req.Header.Add(httpstream.HeaderConnection, httpstream.HeaderUpgrade)
+	req.Header.Add(httpstream.HeaderUpgrade, spdystream.HeaderSpdy31)
+	var tlsConfig *tls.Config
+	if req.URL.Scheme == "https" {
+		tlsConfig = this.tlsConfig
+	}
+	conn, err := dialThrough(this.proxy, canonicalAddress(req.URL), tlsConfig, this.timeout, this.keepAlive)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	this.mutex.Lock()
+	this.conns[resp] = &bufferedConn{Conn: conn, reader: reader}
+	this.mutex.Unlock()
+	return resp, nil
+}
+
+func (this *proxyUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	this.mutex.Lock()
+	conn, ok := this.conns[resp]
+	delete(this.conns, resp)
+	this.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unable to upgrade connection: the response is not from this upgrader")
+	}
+	connection := strings.ToLower(resp.Header.Get(httpstream.HeaderConnection))
+	upgrade := strings.ToLower(resp.Header.Get(httpstream.HeaderUpgrade))
+	if resp.StatusCode != http.StatusSwitchingProtocols || !strings.Contains(connection, "upgrade") || !strings.Contains(upgrade, strings.ToLower(spdystream.HeaderSpdy31)) {
+		defer conn.Close()
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unable to upgrade connection: %s", strings.TrimSpace(string(body)))
+	}
+	return spdystream.NewClientConnection(conn)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// verbosity is 1 with -v and 2 with -vv.
+var verbosity int
+
+// klogLevels are the klog levels for each verbosity. At 4, client-go logs
+// retries and throttling, and at 6 every API request. The levels above that
+// log the request headers, including the bearer token.
+var klogLevels = []int{0, 4, 6}
+
+// setupClientGoLog sends client-go's log, which uses klog, to Log instead of
+// to files in the temp directory. It must be called before the clients are
+// created, since the level is checked when the transports are built.
+func setupClientGoLog() {
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	flags.Set("stderrthreshold", "FATAL")
+	flags.Set("v", strconv.Itoa(klogLevels[verbosity]))
+	// klog writes every message to the outputs of its severity and all
+	// below it, so only the lowest one is kept.
+	for _, severity := range []string{"WARNING", "ERROR", "FATAL"} {
+		klog.SetOutputBySeverity(severity, ioutil.Discard)
+	}
+	klog.SetOutputBySeverity("INFO", klogWriter{})
+}
+
+// klogWriter logs klog's lines, which look like
+// "E1014 05:34:31.123456   42 file.go:12] message".
+type klogWriter struct{}
+
+func (this klogWriter) Write(b []byte) (int, error) {
+	line := strings.TrimSuffix(string(b), "\n")
+	if line == "" {
+		return len(b), nil
+	}
+	msg := line
+	if n := strings.Index(line, "] "); n != -1 {
+		msg = line[n+2:]
+	}
+	switch line[0] {
+	case 'E', 'F':
+		Log{}.Errorf("client-go: %s", msg)
+	case 'W':
+		Log{}.Warnf("client-go: %s", msg)
+	default:
+		Log{}.Debugf("client-go: %s", msg)
+	}
+	return len(b), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ListPods prints the pods in namespace that match selector, with their
+// phase, readiness, node and container ports, to help with writing a tunnel.
+// It connects the same way as the tunnels do. Without a context name, the
+// current context in kubeconfig is used, and without a namespace, the
+// context's default namespace.
+func ListPods(w io.Writer, context Context, namespace string, selector string) error {
+	if context.Name == "" && !context.InCluster {
+		rawConfig, err := clientConfig(context).RawConfig()
+		if err != nil {
+			return err
+		}
+		context.Name = rawConfig.CurrentContext
+	}
+	if namespace == "" {
+		var err error
+		if namespace, err = defaultNamespace(context); err != nil {
+			return err
+		}
+		if namespace == "" {
+			namespace = "default"
+		}
+	}
+	_, clientSet, err := NewClient(context)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), DefaultDiscoveryTimeout)
+	defer cancel()
+	list, err := listPods(ctx, clientSet, namespace, metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return err
+	}
+	if len(list.Items) == 0 {
+		return fmt.Errorf("No pods in namespace %s match %q", namespace, selector)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPHASE\tREADY\tNODE\tPORTS")
+	for _, pod := range list.Items {
+		ready := 0
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Ready {
+				ready++
+			}
+		}
+		node := pod.Spec.NodeName
+		if node == "" {
+			node = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%s\t%s\n", pod.Name, pod.Status.Phase, ready, len(pod.Spec.Containers), node, describeContainerPorts(&pod))
+	}
+	return tw.Flush()
+}
+
+// describeContainerPorts lists the ports that the pod's containers declare,
+// like "http:8080/TCP, 9090/TCP".
+func describeContainerPorts(pod *v1.Pod) string {
+	var ports []string
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			description := strconv.Itoa(int(port.ContainerPort)) + "/" + string(port.Protocol)
+			if port.Name != "" {
+				description = port.Name + ":" + description
+			}
+			ports = append(ports, description)
+		}
+	}
+	if len(ports) == 0 {
+		return "-"
+	}
+	return strings.Join(ports, ", ")
+}
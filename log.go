@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log writes status messages, either as plain text or as one JSON object per
+// line. The fields say where a message comes from and are all optional.
+type Log struct {
+	Context   string
+	Namespace string
+	Tunnel    string
+	// Name is the tunnel's name, if it has one.
+	Name      string
+	LocalPort int
+	Pod       string
+	Node      string
+}
+
+// logFormat is either "text" or "json".
+var logFormat = "text"
+
+func isLogFormat(format string) bool {
+	return format == "text" || format == "json"
+}
+
+// logLevel is the lowest level that is logged, either "debug", "info",
+// "warning" or "error". Events are logged at info level, but are only hidden
+// at error level.
+var logLevel = "info"
+
+var logLevels = map[string]int{
+	"debug":   0,
+	"info":    1,
+	"warning": 2,
+	"error":   3,
+}
+
+func isLogLevel(level string) bool {
+	_, ok := logLevels[level]
+	return ok
+}
+
+// noColor turns off the colored context tags, which are otherwise used when
+// writing to a terminal.
+var noColor = os.Getenv("NO_COLOR") != ""
+
+// contextColors are the ANSI colors for the context tags.
+var contextColors = []int{31, 32, 33, 34, 35, 36, 91, 92, 93, 94, 95, 96}
+
+func useColor(w io.Writer) bool {
+	if noColor {
+		return false
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// contextTag returns "[context]", or "[context/name]" for a named tunnel,
+// colored with a color picked from the context name so that it stays the
+// same between runs.
+func contextTag(context string, name string, color bool) string {
+	tag := context
+	if name != "" {
+		tag += "/" + name
+	}
+	if !color {
+		return "[" + tag + "]"
+	}
+	h := fnv.New32a()
+	h.Write([]byte(context))
+	return fmt.Sprintf("\x1b[%dm[%s]\x1b[0m", contextColors[h.Sum32()%uint32(len(contextColors))], tag)
+}
+
+// logOutput is where messages are written, either stdout or the log_file.
+var logOutput io.Writer = os.Stdout
+
+// Shared by all loggers so that concurrent tunnels don't interleave their output.
+var logMutex sync.Mutex
+
+// logged returns whether messages of the level are logged. The log_level can
+// change when the config is reloaded, so it's read under logMutex.
+func logged(level string) bool {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	return logLevels[logLevel] <= logLevels[level]
+}
+
+func (this Log) WithPod(pod string) Log {
+	this.Pod = pod
+	return this
+}
+
+func (this Log) Debugf(format string, a ...interface{}) {
+	if logged("debug") {
+		this.write(logOutput, "debug", fmt.Sprintf(format, a...))
+	}
+}
+
+func (this Log) Infof(format string, a ...interface{}) {
+	if logged("info") {
+		this.write(logOutput, "info", fmt.Sprintf(format, a...))
+	}
+}
+
+// Eventf logs that a tunnel became ready or stopped, which is still logged
+// with -quiet.
+func (this Log) Eventf(format string, a ...interface{}) {
+	if logged("warning") {
+		this.write(logOutput, "info", fmt.Sprintf(format, a...))
+	}
+}
+
+func (this Log) Warnf(format string, a ...interface{}) {
+	if logged("warning") {
+		this.write(logOutput, "warning", fmt.Sprintf(format, a...))
+	}
+}
+
+func (this Log) Errorf(format string, a ...interface{}) {
+	this.write(logOutput, "error", fmt.Sprintf(format, a...))
+}
+
+// Fatalf logs the error to stderr, and to the log_file if there is one, and
+// exits.
+func (this Log) Fatalf(format string, a ...interface{}) {
+	if logOutput != os.Stdout {
+		this.write(logOutput, "error", fmt.Sprintf(format, a...))
+	}
+	this.write(os.Stderr, "error", fmt.Sprintf(format, a...))
+	os.Exit(1)
+}
+
+func (this Log) write(w io.Writer, level string, msg string) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+
+	if logFormat == "json" {
+		line, _ := json.Marshal(struct {
+			Ts        string `json:"ts"`
+			Level     string `json:"level"`
+			Context   string `json:"context,omitempty"`
+			Namespace string `json:"namespace,omitempty"`
+			Tunnel    string `json:"tunnel,omitempty"`
+			Name      string `json:"name,omitempty"`
+			LocalPort int    `json:"local_port,omitempty"`
+			Pod       string `json:"pod,omitempty"`
+			Node      string `json:"node,omitempty"`
+			Msg       string `json:"msg"`
+		}{
+			Ts:        time.Now().Format(time.RFC3339Nano),
+			Level:     level,
+			Context:   this.Context,
+			Namespace: this.Namespace,
+			Tunnel:    this.Tunnel,
+			Name:      this.Name,
+			LocalPort: this.LocalPort,
+			Pod:       this.Pod,
+			Node:      this.Node,
+			Msg:       msg,
+		})
+		fmt.Fprintf(w, "%s\n", line)
+		return
+	}
+
+	if level == "error" {
+		msg = "Error: " + msg
+	} else if level == "warning" {
+		msg = "Warning: " + msg
+	}
+	if this.Context != "" {
+		fmt.Fprintf(w, "%s %s\n", contextTag(this.Context, this.Name, useColor(w)), msg)
+	} else {
+		fmt.Fprintf(w, "%s\n", msg)
+	}
+}
+
+// Logger receives the output of client-go's port forwarder. Its regular
+// output, like "Handling connection for 8080", is only logged with -v, while
+// its error output always is.
+type Logger struct {
+	Log Log
+	Tag string
+	Err bool
+}
+
+func (this *Logger) Write(b []byte) (int, error) {
+	msg := strings.TrimSuffix(string(b), "\n")
+	logMutex.Lock()
+	text := logFormat != "json"
+	logMutex.Unlock()
+	if text {
+		msg = fmt.Sprintf("Logger: %s, %s", this.Tag, msg)
+	}
+	if this.Err {
+		this.Log.Warnf("%s", msg)
+	} else if verbosity > 0 {
+		this.Log.Debugf("%s", msg)
+	}
+	return len(b), nil
+}
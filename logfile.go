@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// rotatingFile is a log file that is rotated once it would grow past
+// maxSize. The old files are renamed to path.1, path.2 and so on, keeping at
+// most maxBackups of them. It is only written to while holding logMutex.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	this := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := this.open(); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+func (this *rotatingFile) open() error {
+	file, err := os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	this.file, this.size = file, info.Size()
+	return nil
+}
+
+func (this *rotatingFile) Write(b []byte) (int, error) {
+	if this.size > 0 && this.size+int64(len(b)) > this.maxSize {
+		if err := this.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not rotate %s: %s\n", this.path, err.Error())
+		}
+	}
+	n, err := this.file.Write(b)
+	this.size += int64(n)
+	return n, err
+}
+
+func (this *rotatingFile) rotate() error {
+	this.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", this.path, this.maxBackups))
+	for i := this.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", this.path, i), fmt.Sprintf("%s.%d", this.path, i+1))
+	}
+	if this.maxBackups > 0 {
+		os.Rename(this.path, this.path+".1")
+	} else {
+		os.Remove(this.path)
+	}
+	return this.open()
+}
@@ -1,173 +1,1398 @@
 package main
 
 import (
+	gocontext "context"
+	"crypto/tls"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"os/user"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	spdystream "k8s.io/apimachinery/pkg/util/httpstream/spdy"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/portforward"
 	"k8s.io/client-go/transport/spdy"
-
-	"github.com/BurntSushi/toml"
 )
 
-type Config struct {
-	Contexts []Context `toml:"context"`
+// stopWarning is how long before stop_after a warning is logged.
+const stopWarning = time.Minute
+
+func main() {
+	configFlag := flag.String("config", "kube-tunnel-proxy.toml", "Path or URL of the config file, a ConfigMap key like configmap://namespace/name/key, or - to read it from stdin. Falls back to $KUBE_TUNNEL_PROXY_CONFIG if not set.")
+	formatFlag := flag.String("format", "", "Config format, either toml or yaml. Defaults to yaml for .yaml and .yml files, and toml otherwise.")
+	skipPortCheck := flag.Bool("skip-port-check", false, "Don't check that the local ports are free before starting the tunnels.")
+	var contextNames listFlag
+	flag.Var(&contextNames, "context", "Only start the tunnels for this context. Can be repeated or comma-separated.")
+	var tags listFlag
+	flag.Var(&tags, "tags", "Only start the tunnels that have one of these tags. Can be repeated or comma-separated.")
+	showVersion := flag.Bool("version", false, "Print the version and exit.")
+	initConfig := flag.Bool("init", false, "Write a sample config to the -config path, or to stdout if -config is not set, and exit.")
+	force := flag.Bool("force", false, "Allow -init to overwrite an existing file.")
+	dryRun := flag.Bool("dry-run", false, "List the pods that each tunnel would forward to, and exit without forwarding.")
+	listPodsFlag := flag.Bool("list-pods", false, "List the pods matching -selector in -namespace, using the first -context or the current one from kubeconfig, and exit. Doesn't need a config.")
+	namespaceFlag := flag.String("namespace", "", "The namespace for -list-pods. Defaults to the context's namespace.")
+	selectorFlag := flag.String("selector", "", "The label selector for -list-pods, e.g. app=api. Lists all pods if not set.")
+	check := flag.Bool("check", false, "Check that every context's cluster is reachable and count the pods that each tunnel matches, and exit.")
+	maxConcurrency := flag.Int("max-concurrency", 16, "How many tunnels can look up pods or connect at the same time. Zero means no limit.")
+	readyFile := flag.String("ready-file", "", "Create this file once all tunnels are ready.")
+	portsFile := flag.String("ports-file", "", "Write the local ports of the tunnels to this file as JSON once all tunnels are ready, and update it when they reconnect.")
+	startupTimeout := flag.Duration("startup-timeout", 0, "Exit with an error if not all tunnels are ready within this time. Zero means no timeout.")
+	noColorFlag := flag.Bool("no-color", false, "Don't color the log output. Colors are only used when writing to a terminal, and can also be turned off with $NO_COLOR.")
+	logFormatFlag := flag.String("log-format", "", "Log format, either text or json. Overrides log_format in the config.")
+	verbose := flag.Bool("v", false, "Like -debug, but also log the output of client-go's port forwarder, like every connection it handles, and when client-go retries or throttles API requests.")
+	veryVerbose := flag.Bool("vv", false, "Like -v, but also log every API request, and the URL and headers of every port forward request.")
+	debug := flag.Bool("debug", false, "Log debug information, like the whole config after it is decoded. Overrides -quiet and log_level in the config.")
+	quiet := flag.Bool("quiet", false, "Only log warnings, errors, and when tunnels become ready or stop. Overrides log_level in the config.")
+	watchConfigFlag := flag.Bool("watch-config", false, "Reload the config when the file changes, like on SIGHUP.")
+	onceFlag := flag.Bool("once", false, "Stop every tunnel after its first connection is done, and exit once they all have, with an error if any of them failed.")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for the tunnels to stop after SIGINT or SIGTERM before exiting anyway. A second signal exits right away.")
+	stopAfter := flag.Duration("stop-after", 0, "Stop all tunnels and exit after this long, e.g. 2h. Overrides stop_after in the config. Zero means never.")
+	flag.Parse()
+	if *noColorFlag {
+		noColor = true
+	}
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if *logFormatFlag != "" {
+		if !isLogFormat(*logFormatFlag) {
+			Log{}.Fatalf("Unknown -log-format %q, must be text or json.", *logFormatFlag)
+		}
+		logFormat = *logFormatFlag
+	}
+	if *veryVerbose {
+		verbosity = 2
+	} else if *verbose {
+		verbosity = 1
+	}
+	setupClientGoLog()
+	if *debug || verbosity > 0 {
+		logLevel = "debug"
+	} else if *quiet {
+		logLevel = "warning"
+	}
+
+	if *initConfig {
+		if !isFlagSet("config") || *configFlag == "-" {
+			fmt.Print(sampleConfig)
+			return
+		}
+		if _, err := os.Stat(*configFlag); err == nil && !*force {
+			Log{}.Fatalf("%s already exists, use -force to overwrite it.", *configFlag)
+		}
+		if err := ioutil.WriteFile(*configFlag, []byte(sampleConfig), 0644); err != nil {
+			Log{}.Fatalf("Could not write %s: %s", *configFlag, err.Error())
+		}
+		Log{}.Infof("Wrote a sample config to %s.", *configFlag)
+		return
+	}
+
+	if *listPodsFlag {
+		var context Context
+		if len(contextNames) > 0 {
+			context.Name = contextNames[0]
+		}
+		if err := ListPods(os.Stdout, context, *namespaceFlag, *selectorFlag); err != nil {
+			Log{}.Fatalf("%s", err.Error())
+		}
+		return
+	}
+
+	if *formatFlag != "" && *formatFlag != FormatTOML && *formatFlag != FormatYAML {
+		Log{}.Fatalf("Unknown -format %q, must be toml or yaml.", *formatFlag)
+	}
+
+	configPath := *configFlag
+	if !isFlagSet("config") {
+		if envPath := os.Getenv("KUBE_TUNNEL_PROXY_CONFIG"); envPath != "" {
+			configPath = envPath
+		} else if _, err := os.Stat(configPath); os.IsNotExist(err) {
+			usr, err := user.Current()
+			if err != nil {
+				Log{}.Fatalf("Could not locate your home directory.")
+			}
+			configPath = fmt.Sprintf("%s/.kube-tunnel-proxy.toml", usr.HomeDir)
+		}
+	}
+
+	Log{}.Infof("%s", versionString())
+	config, err := loadConfig(configPath, *formatFlag, contextNames, tags, *logFormatFlag, *debug || *quiet || verbosity > 0)
+	if err != nil {
+		Log{}.Fatalf("%s", err.Error())
+	}
+	if *onceFlag {
+		config.SetOnce()
+	}
+	if isFlagSet("stop-after") {
+		if *stopAfter < 0 {
+			Log{}.Fatalf("-stop-after %s can't be negative.", *stopAfter)
+		}
+		config.StopAfter.Duration = *stopAfter
+	}
+
+	if *dryRun {
+		if failed := DryRun(config); failed > 0 {
+			Log{}.Fatalf("%d of %d tunnels could not be resolved to any pods.", failed, config.NumTunnels())
+		}
+		return
+	}
+
+	if *check {
+		if failed := Check(config); failed > 0 {
+			Log{}.Fatalf("%d of %d contexts could not be reached.", failed, len(config.Contexts))
+		}
+		return
+	}
+
+	if config.LogFile != "" {
+		file, err := openRotatingFile(config.LogFile, int64(config.LogMaxSizeMB)*1024*1024, *config.LogMaxBackups)
+		if err != nil {
+			Log{}.Fatalf("Could not open log_file %s: %s", config.LogFile, err.Error())
+		}
+		Log{}.Infof("Logging to %s.", config.LogFile)
+		logOutput = file
+	}
+
+	if !*skipPortCheck {
+		if errs := checkLocalPorts(config); len(errs) > 0 {
+			problems := make([]string, len(errs))
+			for i, err := range errs {
+				problems[i] = err.Error()
+			}
+			Log{}.Fatalf("%s", strings.Join(problems, "\n"))
+		}
+	}
+
+	connectSlots = NewSemaphore(*maxConcurrency)
+	startedAt := time.Now()
+	logBanner(config, configPath)
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	// The tunnels get their drain_timeout on top of -shutdown-timeout.
+	timeout := *shutdownTimeout + config.MaxDrainTimeout()
+	// stop_after shuts down the same way as a signal.
+	var stopTimer <-chan time.Time
+	if stop := config.StopAfter.Duration; stop > 0 {
+		Log{}.Infof("Stopping all tunnels after %s, at %s.", stop, startedAt.Add(stop).Format("15:04:05"))
+		stopTimer = time.After(stop)
+		if stop > stopWarning {
+			time.AfterFunc(stop-stopWarning, func() {
+				Log{}.Warnf("Stopping all tunnels in %s, because of stop_after %s.", stopWarning, stop)
+			})
+		}
+	}
+	go func() {
+		select {
+		case sig := <-signals:
+			Log{}.Infof("Received %s, stopping all tunnels.", sig)
+		case <-stopTimer:
+			Log{}.Eventf("Reached stop_after %s, stopping all tunnels.", config.StopAfter.Duration)
+		}
+		cancel()
+		select {
+		case sig := <-signals:
+			Log{}.Fatalf("Received %s again, exiting without waiting for the tunnels to stop.", sig)
+		case <-time.After(timeout):
+			Log{}.Fatalf("The tunnels did not stop within %s, exiting.", timeout)
+		}
+	}()
+
+	var metricsServer *http.Server
+	if config.MetricsAddr != "" {
+		metricsServer = StartMetricsServer(config.MetricsAddr)
+	}
+	if config.OtelEndpoint != "" {
+		tracer = NewTracer(config.OtelEndpoint)
+		go tracer.Run(ctx)
+		Log{}.Infof("Sending traces to %s.", tracer.url)
+	}
+
+	proxy := NewProxy(ctx)
+	var failedExit int32
+	proxy.OnFailure = func(key string) {
+		Log{}.Errorf("%s failed, stopping all tunnels since it has exit_on_failure.", key)
+		atomic.StoreInt32(&failedExit, 1)
+		cancel()
+	}
+	var healthServer *http.Server
+	if config.HealthAddr != "" {
+		healthServer = StartHealthServer(config.HealthAddr, proxy)
+	}
+	var controlListener net.Listener
+	if config.ControlSocket != "" {
+		controlListener, err = StartControlServer(config.ControlSocket, proxy)
+		if err != nil {
+			Log{}.Fatalf("Could not serve the control socket on %s: %s", config.ControlSocket, err.Error())
+		}
+	}
+	if *portsFile != "" {
+		watchPortsFile(proxy, *portsFile)
+	}
+	diff := proxy.Apply(config)
+	if len(diff.ContextErrors) > 0 {
+		var failed []string
+		for _, context := range config.Contexts {
+			if err, ok := diff.ContextErrors[context.Name]; ok {
+				failed = append(failed, fmt.Sprintf("- %s: %s", context.Name, err.Error()))
+			}
+		}
+		msg := fmt.Sprintf("Failed to set up %d of %d contexts:\n%s", len(diff.ContextErrors), len(config.Contexts), strings.Join(failed, "\n"))
+		if len(diff.ContextErrors) == len(config.Contexts) {
+			Log{}.Fatalf("%s", msg)
+		}
+		Log{}.Errorf("%s", msg)
+	}
+
+	go func() {
+		notReady := append(diff.Failed, proxy.WaitReady(diff.Added, *startupTimeout)...)
+		if ctx.Err() != nil {
+			return
+		}
+		if len(notReady) > 0 {
+			if *startupTimeout > 0 {
+				Log{}.Fatalf("%d tunnels did not become ready within %s:\n- %s", len(notReady), *startupTimeout, strings.Join(notReady, "\n- "))
+			}
+			Log{}.Warnf("%d tunnels did not become ready:\n- %s", len(notReady), strings.Join(notReady, "\n- "))
+			return
+		}
+		Log{}.Eventf("ALL TUNNELS READY")
+		if *readyFile != "" {
+			if err := ioutil.WriteFile(*readyFile, nil, 0644); err != nil {
+				Log{}.Errorf("Could not create %s: %s", *readyFile, err.Error())
+			}
+		}
+	}()
+
+	// Reloads are serialized, since both SIGHUP and -watch-config can trigger
+	// them.
+	var reloadMutex sync.Mutex
+	reload := func() {
+		reloadMutex.Lock()
+		defer reloadMutex.Unlock()
+		config, err := loadConfig(configPath, *formatFlag, contextNames, tags, *logFormatFlag, *debug || *quiet || verbosity > 0)
+		if err != nil {
+			Log{}.Errorf("Keeping the current tunnels: %s", err.Error())
+			return
+		}
+		if *onceFlag {
+			config.SetOnce()
+		}
+		diff := proxy.Apply(config)
+		Log{}.Infof("Reloaded the config: %d added, %d removed, %d kept.", len(diff.Added), len(diff.Removed), len(diff.Kept))
+		for _, key := range diff.Added {
+			Log{}.Infof("+ %s", key)
+		}
+		for _, key := range diff.Removed {
+			Log{}.Infof("- %s", key)
+		}
+	}
+
+	dumps := make(chan os.Signal, 1)
+	signal.Notify(dumps, syscall.SIGUSR1)
+	go func() {
+		for range dumps {
+			states := proxy.States()
+			logMutex.Lock()
+			PrintStatus(os.Stderr, states)
+			logMutex.Unlock()
+		}
+	}()
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			Log{}.Infof("Received SIGHUP, reloading the config.")
+			reload()
+		}
+	}()
+
+	if *watchConfigFlag {
+		watch := watchConfig
+		if isConfigMap(configPath) {
+			watch = watchConfigMap
+		}
+		if configPath == "-" || isURL(configPath) {
+			Log{}.Warnf("-watch-config only works with config files and ConfigMaps, not with %s.", configPath)
+		} else if err := watch(configPath, func() {
+			Log{}.Infof("%s changed, reloading the config.", configPath)
+			reload()
+		}); err != nil {
+			Log{}.Errorf("Could not watch %s: %s", configPath, err.Error())
+		} else {
+			Log{}.Infof("Watching %s for changes.", configPath)
+		}
+	}
+
+	if controlListener != nil {
+		// Keep running when all tunnels have been stopped, since they can be
+		// started again.
+		<-ctx.Done()
+	}
+	numStarted, numStopped := proxy.Wait()
+	Log{}.Eventf("Stopped %d of %d tunnels cleanly.", numStopped, numStarted)
+	if failed := proxy.NeverStarted(); len(failed) > 0 {
+		Log{}.Errorf("%d tunnels never started:\n- %s", len(failed), strings.Join(failed, "\n- "))
+	}
+	logReport(time.Since(startedAt), proxy.States())
+
+	// A new ctx, since the goroutines above still use the cancelled one.
+	shutdownCtx, cancelShutdown := gocontext.WithTimeout(gocontext.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if metricsServer != nil {
+		metricsServer.Shutdown(shutdownCtx)
+	}
+	if healthServer != nil {
+		healthServer.Shutdown(shutdownCtx)
+	}
+	if controlListener != nil {
+		controlListener.Close()
+	}
+	if tracer != nil {
+		tracer.Flush()
+	}
+	if atomic.LoadInt32(&failedExit) == 1 || *onceFlag && numStopped < numStarted {
+		os.Exit(1)
+	}
+}
+
+// loadConfig reads the config, applies the filters from the flags, and
+// validates the result.
+func loadConfig(configPath string, formatFlag string, contextNames []string, tags []string, logFormatFlag string, logLevelFlag bool) (Config, error) {
+	Log{}.Infof("Loading config from: %s", configPath)
+	data, err := ReadConfig(configPath)
+	if err != nil {
+		return Config{}, fmt.Errorf("Could not read config file %s: %s", configPath, err.Error())
+	}
+	data, err = ExpandEnv(data)
+	if err != nil {
+		return Config{}, err
+	}
+
+	format := formatFlag
+	if format == "" {
+		format = ConfigFormat(configPath)
+	}
+	config, err := DecodeConfig(configPath, format, data)
+	if err != nil {
+		return Config{}, err
+	}
+	logMutex.Lock()
+	if logFormatFlag == "" && isLogFormat(config.LogFormat) {
+		logFormat = config.LogFormat
+	}
+	if !logLevelFlag && isLogLevel(config.LogLevel) {
+		logLevel = config.LogLevel
+	}
+	logMutex.Unlock()
+	config.SetDefaults()
+	Log{}.Debugf("%+v", config)
+
+	if len(contextNames) > 0 {
+		if missing := config.FilterContexts(contextNames); len(missing) > 0 {
+			return Config{}, fmt.Errorf("Contexts not found in %s: %s", configPath, strings.Join(missing, ", "))
+		}
+	}
+	names := make([]string, len(config.Contexts))
+	for i, context := range config.Contexts {
+		names[i] = context.Name
+	}
+	Log{}.Infof("Activating contexts: %s", strings.Join(names, ", "))
+
+	total := config.NumTunnels()
+	disabled, untagged := config.FilterTunnels(tags)
+	Log{}.Infof("Starting %d of %d tunnels (%d disabled, %d without a matching tag).", config.NumTunnels(), total, disabled, untagged)
+
+	// Tunnels without a namespace use the context's default namespace, or
+	// "default" if it has none.
+	for i, context := range config.Contexts {
+		var namespace string
+		var lookedUp bool
+		for j, tunnel := range context.Tunnels {
+			if tunnel.Namespace != "" {
+				continue
+			}
+			if !lookedUp {
+				var err error
+				namespace, err = defaultNamespace(context)
+				if err != nil {
+					Log{Context: context.Name}.Warnf("Could not look up the default namespace: %s", err.Error())
+				}
+				lookedUp = true
+			}
+			log := Log{Context: context.Name, Tunnel: tunnel.Target(), Name: tunnel.Name}
+			if namespace != "" {
+				log.Infof("Using the context's default namespace %s.", namespace)
+				config.Contexts[i].Tunnels[j].Namespace = namespace
+			} else {
+				log.Warnf("No namespace is set, and the context has no default namespace. Using %s.", v1.NamespaceDefault)
+				config.Contexts[i].Tunnels[j].Namespace = v1.NamespaceDefault
+			}
+		}
+	}
+
+	if err := overrideLocalPorts(&config); err != nil {
+		return Config{}, err
+	}
+
+	if errs := config.Validate(); len(errs) > 0 {
+		problems := make([]string, len(errs))
+		for i, err := range errs {
+			problems[i] = fmt.Sprintf("%d. %s", i+1, err.Error())
+		}
+		return Config{}, fmt.Errorf("Found %d problems in %s:\n%s", len(errs), configPath, strings.Join(problems, "\n"))
+	}
+
+	for _, context := range config.Contexts {
+		for _, tunnel := range context.Tunnels {
+			Log{Context: context.Name, Tunnel: tunnel.Target(), Name: tunnel.Name}.Infof("Tunnel %s/%s: %s", tunnel.Namespace, tunnel.Target(), describePorts(tunnel))
+		}
+	}
+	return config, nil
+}
+
+// overrideLocalPorts sets the local_port of named tunnels from environment
+// variables like KTP_API_LOCAL_PORT for a tunnel named api, for quick changes
+// without editing the config. The name is upper-cased, with anything but
+// letters and digits replaced with _.
+func overrideLocalPorts(config *Config) error {
+	for i, context := range config.Contexts {
+		for j, tunnel := range context.Tunnels {
+			if tunnel.Name == "" {
+				continue
+			}
+			variable := "KTP_" + envName(tunnel.Name) + "_LOCAL_PORT"
+			value, ok := os.LookupEnv(variable)
+			if !ok || value == "" {
+				continue
+			}
+			var port AutoPort
+			var err error
+			if n, parseErr := strconv.ParseInt(value, 10, 64); parseErr == nil {
+				err = port.UnmarshalTOML(n)
+			} else {
+				err = port.UnmarshalTOML(value)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s", variable, err.Error())
+			}
+			if port == autoPortSet {
+				port = 0
+			}
+			Log{Context: context.Name, Tunnel: tunnel.Target(), Name: tunnel.Name}.Infof("Using local_port %s from $%s instead of %s.", value, variable, describeLocalPort(int(tunnel.LocalPort)))
+			config.Contexts[i].Tunnels[j].LocalPort = port
+		}
+	}
+	return nil
+}
+
+// envName turns a tunnel name into a part of an environment variable name.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// describeLocalPort returns the port, or "auto" for 0.
+func describeLocalPort(port int) string {
+	if port == 0 {
+		return "auto"
+	}
+	return strconv.Itoa(port)
 }
-type Context struct {
-	Name    string
-	Tunnels []Tunnel `toml:"tunnel"`
+
+// describePorts describes the tunnel's port mappings, like
+// "127.0.0.1:8080 -> 80, 127.0.0.1:auto -> http".
+func describePorts(tunnel Tunnel) string {
+	var ports []string
+	for _, mapping := range tunnel.PortMappings() {
+		local := describeLocalPort(mapping.Local)
+		if tunnel.Mode == ModeFanout {
+			// One port per pod, counting up.
+			local += "+"
+		}
+		address := joinAddresses(tunnel.BindAddresses(mapping), local)
+		if tunnel.Socks {
+			ports = append(ports, fmt.Sprintf("SOCKS on %s", address))
+		} else {
+			ports = append(ports, fmt.Sprintf("%s -> %s", address, mapping.Pod))
+		}
+	}
+	return strings.Join(ports, ", ")
 }
-type Tunnel struct {
-	Namespace string
-	Selector  string
-	PodPort   int `toml:"pod_port"`
-	LocalPort int `toml:"local_port"`
+
+// joinAddresses describes a port on several addresses, like
+// "127.0.0.1,[::1]:8080".
+func joinAddresses(addresses []string, port string) string {
+	var hosts []string
+	for _, address := range addresses {
+		if strings.Contains(address, ":") {
+			address = "[" + address + "]"
+		}
+		hosts = append(hosts, address)
+	}
+	return strings.Join(hosts, ",") + ":" + port
 }
 
-type Logger struct {
-	Context string
-	Tag     string
+// checkLocalPorts makes sure that nothing else is listening on the tunnels'
+// local ports, since client-go's error for that case is hard to decipher.
+func checkLocalPorts(config Config) []error {
+	var errs []error
+	for _, context := range config.Contexts {
+		for _, tunnel := range context.Tunnels {
+			for _, mapping := range tunnel.PortMappings() {
+				if mapping.Local == 0 {
+					continue
+				}
+				for _, address := range tunnel.BindAddresses(mapping) {
+					listener, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(mapping.Local)))
+					if err != nil {
+						errs = append(errs, fmt.Errorf("[%s] local port %d on %s for %s is already in use (%s)", context.Name, mapping.Local, address, tunnel.Target(), err.Error()))
+						continue
+					}
+					listener.Close()
+				}
+			}
+		}
+	}
+	return errs
 }
 
-func (this *Logger) Write(b []byte) (int, error) {
-	fmt.Printf("[%s] Logger: %s, %s", this.Context, this.Tag, string(b))
-	return 0, nil
+// listFlag collects the values of a flag that can be repeated, splitting
+// each value on commas.
+type listFlag []string
+
+func (this *listFlag) String() string {
+	return strings.Join(*this, ",")
 }
 
-func main() {
-	configPath := "kube-tunnel-proxy.toml"
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		usr, err := user.Current()
+func (this *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*this = append(*this, v)
+		}
+	}
+	return nil
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func clientConfig(context Context) clientcmd.ClientConfig {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if context.Kubeconfig != "" {
+		loadingRules.ExplicitPath = context.Kubeconfig
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules,
+		&clientcmd.ConfigOverrides{
+			CurrentContext: context.Name,
+		})
+}
+
+// explicitConfig connects to the context's server with its token and CA,
+// without kubeconfig.
+func explicitConfig(context Context) (*rest.Config, error) {
+	token := context.Token
+	if context.TokenFile != "" {
+		data, err := ioutil.ReadFile(context.TokenFile)
 		if err != nil {
-			fmt.Println("Error: Could not locate your home directory.")
-			os.Exit(1)
+			return nil, err
 		}
-		configPath = fmt.Sprintf("%s/.kube-tunnel-proxy.toml", usr.HomeDir)
+		token = strings.TrimSpace(string(data))
 	}
+	return &rest.Config{
+		Host:        context.Server,
+		BearerToken: token,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAFile:   context.CAFile,
+			Insecure: context.Insecure,
+		},
+	}, nil
+}
+
+// inClusterNamespaceFile holds the namespace of the pod that we run in.
+const inClusterNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
 
-	fmt.Printf("Loading config from: %s\n", configPath)
-	tomlData, err := ioutil.ReadFile(configPath)
+// defaultNamespace returns the namespace that the context is configured with
+// in kubeconfig, or "" if it has none. In-cluster, it is the pod's namespace,
+// and contexts with a server have none.
+func defaultNamespace(context Context) (string, error) {
+	if context.Server != "" {
+		return "", nil
+	}
+	if context.InCluster {
+		namespace, err := ioutil.ReadFile(inClusterNamespaceFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(namespace)), nil
+	}
+	rawConfig, err := clientConfig(context).RawConfig()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return "", err
+	}
+	kubeContext, ok := rawConfig.Contexts[context.Name]
+	if !ok {
+		return "", fmt.Errorf("Context %s not found in kubeconfig", context.Name)
+	}
+	return kubeContext.Namespace, nil
+}
+
+func NewClient(context Context) (*rest.Config, *kubernetes.Clientset, error) {
+	var cfg *rest.Config
+	var err error
+	if context.InCluster {
+		cfg, err = rest.InClusterConfig()
+	} else if context.Server != "" {
+		cfg, err = explicitConfig(context)
+	} else {
+		cfg, err = clientConfig(context).ClientConfig()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// The impersonation headers are added by the transport, so they apply
+	// to the port forwarding as well as to the API calls.
+	if context.ImpersonateUser != "" {
+		cfg.Impersonate = rest.ImpersonationConfig{
+			UserName: context.ImpersonateUser,
+			Groups:   context.ImpersonateGroups,
+		}
+		if len(context.ImpersonateGroups) > 0 {
+			Log{Context: context.Name}.Infof("Impersonating user %s with groups %s.", context.ImpersonateUser, strings.Join(context.ImpersonateGroups, ", "))
+		} else {
+			Log{Context: context.Name}.Infof("Impersonating user %s.", context.ImpersonateUser)
+		}
 	}
 
-	var config Config
-	_, err = toml.Decode(string(tomlData), &config)
+	if context.ProxyURL != "" {
+		withProxy(cfg, context.ProxyURL)
+		Log{Context: context.Name}.Infof("Connecting through the proxy %s.", redactURL(context.ProxyURL))
+	}
+
+	cfg.QPS = float32(context.QPS)
+	cfg.Burst = context.Burst
+	Log{Context: context.Name}.Infof("Limiting API requests to %g per second, with bursts of %d.", cfg.QPS, cfg.Burst)
+
+	clientSet, err := kubernetes.NewForConfig(cfg)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, nil, err
 	}
-	fmt.Println(config)
 
-	var wg sync.WaitGroup
-	for _, context := range config.Contexts {
-		fmt.Printf("[%s] Setting up %d tunnels.\n", context.Name, len(context.Tunnels))
+	return cfg, clientSet, nil
+}
 
-		cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
-			clientcmd.NewDefaultClientConfigLoadingRules(),
-			&clientcmd.ConfigOverrides{
-				CurrentContext: context.Name,
-			}).ClientConfig()
+// PortForward keeps the tunnel forwarding, reconnecting as needed, until
+// ctx is cancelled. A nil error means that the tunnel was stopped cleanly.
+// setUp is called whenever the tunnel goes up, with the pod and the local
+// ports, or down.
+func PortForward(ctx gocontext.Context, cfg *rest.Config, clientSet kubernetes.Interface, context string, protocol string, proxyURL string, tunnel Tunnel, setUp func(up bool, pod string, ports string)) error {
+	// With drain_timeout, the tunnel keeps running for a while after the
+	// parent ctx is cancelled, see below. No values are passed down through
+	// ctx, so it can be replaced.
+	parent := ctx
+	if tunnel.DrainTimeout.Duration > 0 {
+		ctx = gocontext.Background()
+	}
+	ctx, stop := gocontext.WithCancel(ctx)
+	defer stop()
+	stopChan := ctx.Done()
+	log := Log{Context: context, Namespace: tunnel.Namespace, Tunnel: tunnel.Target(), Name: tunnel.Name}
+	name := tunnel.DisplayName(context)
+	fwd := &forwarder{
+		protocol: protocol,
+	}
+	var err error
+	if proxyURL != "" {
+		var upgrader *proxyUpgrader
+		upgrader, err = newProxyUpgrader(cfg, proxyURL, tunnel.DialTimeout.Duration, tunnel.TCPKeepalive.Duration)
+		if err == nil {
+			fwd.upgrader = upgrader
+			fwd.transport, err = rest.HTTPWrappersForConfig(cfg, upgrader)
+		}
+	} else {
+		fwd.transport, fwd.upgrader, err = spdy.RoundTripperFor(cfg)
+	}
+	if err != nil {
+		log.Errorf("%s", err.Error())
+		return err
+	}
+	if protocol != ProtocolSPDY {
+		fwd.websocket, err = newWebsocketDialer(cfg, tunnel.DialTimeout.Duration, tunnel.TCPKeepalive.Duration, proxyURL)
+		if err != nil {
+			log.Errorf("%s", err.Error())
+			return err
+		}
+	}
 
+	// Like the ports, the certificate stays the same across reconnects.
+	var tlsConfig *tls.Config
+	if tunnel.TLS != nil {
+		tlsConfig, err = tunnel.TLS.Config()
 		if err != nil {
-			panic(err.Error())
+			log.Errorf("Could not set up TLS: %s", err.Error())
+			return err
 		}
+	}
 
-		clientSet, err := kubernetes.NewForConfig(cfg)
+	// Pick the ports up front so that they stay the same across reconnects.
+	// From here on, tunnel.Ports holds all of the ports.
+	ports := tunnel.PortMappings()
+	for i := range ports {
+		if ports[i].Local != 0 {
+			continue
+		}
+		ports[i].Local, err = freePort(tunnel.BindAddresses(ports[i])[0])
 		if err != nil {
-			panic(err.Error())
+			log.Errorf("Could not find a free local port: %s", err.Error())
+			return err
+		}
+	}
+	tunnel.LocalPort, tunnel.PodPort, tunnel.Ports = 0, NamedPort{}, ports
+	log.LocalPort = ports[0].Local
+	tunnelMetrics := metrics.Tunnel(context, name, tunnel)
+	defer tunnelMetrics.Unregister()
+	var readyAt int64
+	var attempt int
+	// The hooks get the pod's namespace, which isn't the tunnel's with
+	// namespace = "*".
+	hookTunnel := tunnel
+	onReady := func(pod *v1.Pod) {
+		hookTunnel.Namespace = pod.Namespace
+		atomic.StoreInt64(&readyAt, time.Now().UnixNano())
+		tunnelMetrics.SetUp(true)
+		setUp(true, pod.Name, localPorts(tunnel))
+		if attempt > 0 {
+			tunnelMetrics.IncReconnects()
+		}
+		if tunnel.OnReady != "" {
+			go runHook(log, "on_ready", tunnel.OnReady, context, hookTunnel, pod.Name)
 		}
+	}
 
-		for _, tunnel := range context.Tunnels {
-			wg.Add(1)
-			go PortForward(&wg, cfg, clientSet, context.Name, tunnel)
+	if tunnel.Mode == ModeRoundRobin {
+		log.Infof("Using round-robin mode, every reconnect moves to the next ready pod.")
+	}
+
+	var lastPod string
+	var lastTier int
+	backoff := &Backoff{
+		Min: tunnel.MinBackoff.Duration,
+		Max: tunnel.MaxBackoff.Duration,
+	}
+	// The relays stay open until the tunnel stops, so that the local ports
+	// never go away while reconnecting or idle. Connections that arrive in
+	// between wait for the next session, and wake is signalled.
+	var relays []*relay
+	var relaysMutex sync.Mutex
+	wake := make(chan struct{}, 1)
+	defer func() {
+		relaysMutex.Lock()
+		defer relaysMutex.Unlock()
+		for _, relay := range relays {
+			relay.Close()
+		}
+	}()
+
+	// With drain_timeout, stopping the tunnel first refuses new connections
+	// and waits for the open ones to finish, before the session is closed.
+	if tunnel.DrainTimeout.Duration > 0 {
+		go func() {
+			select {
+			case <-parent.Done():
+			case <-stopChan:
+				return
+			}
+			relaysMutex.Lock()
+			current := relays
+			relaysMutex.Unlock()
+			drainRelays(log, current, tunnel.DrainTimeout.Duration)
+			stop()
+		}()
+	}
+
+	// With once, the tunnel stops after its first connection, and returns
+	// the error that the connection ended with, if any.
+	finished := make(chan error, 1)
+	onceResult := make(chan error, 1)
+	if tunnel.Once {
+		go func() {
+			select {
+			case err := <-finished:
+				log.Infof("The connection is done, stopping the tunnel since it has once.")
+				onceResult <- err
+				stop()
+			case <-stopChan:
+			}
+		}()
+	}
+	stopped := func() error {
+		log.Eventf("Stopped forwarding %s: %s.", tunnel.Target(), tunnelMetrics.Summary())
+		select {
+		case err := <-onceResult:
+			return err
+		default:
+			return nil
+		}
+	}
+	var failures int
+	for ; ; attempt++ {
+		atomic.StoreInt64(&readyAt, 0)
+		err = nil
+		session := StartSpan("session", nil)
+		session.SetAttribute("context", context)
+		session.SetAttribute("namespace", tunnel.Namespace)
+		session.SetAttribute("selector", tunnel.Target())
+		session.SetAttribute("attempt", attempt)
+		relaysMutex.Lock()
+		if relays == nil {
+			relays, err = listenRelays(tunnel, tlsConfig, log, tunnelMetrics, wake, finished)
+		}
+		relaysMutex.Unlock()
+		if err == nil && attempt == 0 && !waitStartupJitter(log, tunnel, stopChan) {
+			endSession(session, nil)
+			return stopped()
+		}
+		if err == nil {
+			err = forwardPod(ctx, clientSet, fwd, log, tunnel, relays, &lastPod, &lastTier, session, onReady)
+		}
+		endSession(session, err)
+		tunnelMetrics.SetUp(false)
+		setUp(false, "", "")
+		if tunnel.OnStop != "" && atomic.LoadInt64(&readyAt) != 0 {
+			runHook(log, "on_stop", tunnel.OnStop, context, hookTunnel, lastPod)
+		}
+		if err == errIdle {
+			log.Infof("No connections for %s, closing the tunnel until the next connection.", tunnel.IdleTimeout.Duration)
+			if !waitForConnection(stopChan, wake, relays) {
+				return stopped()
+			}
+			log.Infof("Reconnecting %s for a new connection.", tunnel.Target())
+			continue
+		}
+		if err == errNoPods && attempt == 0 {
+			log.Errorf("No pods found: %s.", tunnel.Target())
+			return err
+		} else if isAuthError(err) {
+			// Exec plugins are run again on the next attempt, so this can
+			// fix itself once the credentials are refreshed.
+			err = credentialsError(context, err)
+			if attempt == 0 && !tunnel.WaitForPod {
+				log.Errorf("Giving up on %s: %s", tunnel.Target(), err.Error())
+				return err
+			}
+			log.Errorf("%s", err.Error())
+		} else if isPermanent(err) && attempt == 0 && !tunnel.WaitForPod {
+			// Retrying won't help, e.g. without permission to list the pods.
+			log.Errorf("Giving up on %s: %s", tunnel.Target(), err.Error())
+			return err
+		} else if err == errPodGone || err == errFailback || err == errExpired {
+			// Fail over right away, the other pods are probably fine.
+			log.Infof("Reconnecting %s.", tunnel.Target())
+			continue
+		} else if err != nil {
+			log.Errorf("%s", err.Error())
+		}
+
+		// Only attempts that never became ready count against max_reconnects.
+		if atomic.LoadInt64(&readyAt) != 0 {
+			failures = 0
+		} else {
+			failures++
+		}
+		if tunnel.MaxReconnects > 0 && failures > tunnel.MaxReconnects {
+			log.Errorf("Giving up on %s after %d reconnects without becoming ready.", tunnel.Target(), tunnel.MaxReconnects)
+			return errGaveUp
+		}
+		if ready := atomic.LoadInt64(&readyAt); ready != 0 && time.Since(time.Unix(0, ready)) >= backoffResetThreshold {
+			backoff.Reset()
+		}
+		delay := backoff.Next()
+
+		select {
+		case <-stopChan:
+			return stopped()
+		default:
+		}
+		log.Infof("Reconnecting %s in %s.", tunnel.Target(), delay)
+		reconnect := StartSpan("reconnect", session)
+		reconnect.SetAttribute("delay_ms", int(delay/time.Millisecond))
+		select {
+		case <-stopChan:
+			reconnect.End(nil)
+			return stopped()
+		case <-time.After(delay):
+			reconnect.End(nil)
 		}
 	}
-	wg.Wait()
 }
 
-func PortForward(wg *sync.WaitGroup, cfg *rest.Config, clientSet *kubernetes.Clientset, context string, tunnel Tunnel) {
-	defer wg.Done()
+// endSession ends the span of a tunnel session. The errors that just mean
+// that the session is over, like the pod going away, are recorded as the
+// reason instead of failing the span.
+func endSession(span *Span, err error) {
+	if span == nil {
+		return
+	}
+	span.SetAttribute("duration_ms", int(time.Since(span.start)/time.Millisecond))
+	if err == nil || err == errPodGone || err == errIdle || err == errFailback || err == errExpired {
+		if err != nil {
+			span.SetAttribute("end_reason", err.Error())
+		}
+		err = nil
+	}
+	span.End(err)
+}
 
-	pods, err := clientSet.CoreV1().
-		Pods(tunnel.Namespace).
-		List(metav1.ListOptions{
-			LabelSelector: tunnel.Selector,
-		})
+// listenRelays listens on the tunnel's local ports, in the same order as
+// tunnel.Ports. They share the tunnel's max_connections.
+func listenRelays(tunnel Tunnel, tlsConfig *tls.Config, log Log, stats *TunnelMetrics, wake chan<- struct{}, finished chan<- error) ([]*relay, error) {
+	var relays []*relay
+	limiter := newConnLimiter(tunnel)
+	for _, mapping := range tunnel.Ports {
+		relay, err := listenRelay(tunnel, mapping, tlsConfig, log, stats, limiter, wake, finished)
+		if err != nil {
+			for _, relay := range relays {
+				relay.Close()
+			}
+			return nil, err
+		}
+		relays = append(relays, relay)
+	}
+	return relays, nil
+}
+
+// waitStartupJitter waits up to startup_jitter before the tunnel first looks
+// up its pods, so that many tunnels don't hit the API server at once. It
+// returns false if the tunnel was stopped in the meantime.
+func waitStartupJitter(log Log, tunnel Tunnel, stopChan <-chan struct{}) bool {
+	if tunnel.StartupJitter.Duration <= 0 {
+		return true
+	}
+	delay := time.Duration(rand.Int63n(int64(tunnel.StartupJitter.Duration)))
+	log.Debugf("Waiting %s of startup_jitter %s before looking up pods.", delay.Round(time.Millisecond), tunnel.StartupJitter.Duration)
+	select {
+	case <-time.After(delay):
+		return true
+	case <-stopChan:
+		return false
+	}
+}
+
+// waitForConnection waits until one of the relays has a connection waiting,
+// and returns false if stopChan is closed first.
+func waitForConnection(stopChan <-chan struct{}, wake <-chan struct{}, relays []*relay) bool {
+	for {
+		select {
+		case <-stopChan:
+			return false
+		case <-wake:
+		}
+		// wake may be left over from before the tunnel became idle.
+		for _, relay := range relays {
+			if relay.idleFor() == 0 {
+				return true
+			}
+		}
+	}
+}
+
+// internalAddress is where client-go listens for the relays.
+const internalAddress = "127.0.0.1"
+
+// freePort asks the OS for a local port that is currently not in use.
+func freePort(address string) (int, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, "0"))
 	if err != nil {
-		panic(err.Error())
+		return 0, err
 	}
-	if len(pods.Items) < 1 {
-		fmt.Printf("[%s] No pods found: %s.\n", context, tunnel.Selector)
-		return
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// forwarder holds what forwardPod needs to connect to the pods.
+type forwarder struct {
+	transport http.RoundTripper
+	upgrader  spdy.Upgrader
+	websocket *websocketDialer
+	// protocol is spdy or websocket, or auto until the first pod decides.
+	protocol string
+}
+
+// recordingDialer keeps the error from upgrading the connection, since
+// client-go only passes its text on, so that rejected credentials can be told
+// apart from other errors. With -vv, it logs the upgrade request.
+type recordingDialer struct {
+	httpstream.Dialer
+	err error
+	log Log
+	url *url.URL
+}
+
+func (this *recordingDialer) Dial(protocols ...string) (httpstream.Connection, string, error) {
+	if verbosity > 1 {
+		// The credentials and impersonation headers are added by the
+		// transport, and are left out.
+		this.log.Debugf("Upgrading POST %s with %s: %s, %s: %s, %s: %s.", redactURL(this.url.String()),
+			httpstream.HeaderConnection, httpstream.HeaderUpgrade,
+			httpstream.HeaderUpgrade, spdystream.HeaderSpdy31,
+			httpstream.HeaderProtocolVersion, strings.Join(protocols, ", "))
+	}
+	conn, protocol, err := this.Dialer.Dial(protocols...)
+	if err != nil {
+		this.err = err
+	} else if verbosity > 1 {
+		this.log.Debugf("Upgraded to %s.", protocol)
 	}
-	podName := pods.Items[0].Name
+	return conn, protocol, err
+}
 
-	fmt.Printf("[%s] Forwarding localhost:%d to pod %s:%d\n", context, tunnel.LocalPort, podName, tunnel.PodPort)
+// forwardPod picks a pod matching the tunnel's selector and forwards the
+// relays' connections to it until the connection is lost, the pod goes away,
+// the tunnel has been idle for idle_timeout, or ctx is cancelled. lastPod is
+// the name of the previously selected pod, and lastTier the failover tier it
+// was in, and they are updated with the new one. When connected to a failover
+// tier, the session ends once a higher tier has ready pods again. span is the
+// session's span, if tracing. onReady is called once the connections are
+// being forwarded.
+func forwardPod(ctx gocontext.Context, clientSet kubernetes.Interface, fwd *forwarder, log Log, tunnel Tunnel, relays []*relay, lastPod *string, lastTier *int, span *Span, onReady func(*v1.Pod)) error {
+	discover := StartSpan("discover", span)
+	selectors, service, err := resolveSelector(ctx, clientSet, tunnel)
+	if err != nil {
+		discover.End(err)
+		return err
+	}
+	tiers := [][]string{selectors}
+	for _, selector := range tunnel.Failover {
+		tiers = append(tiers, []string{selector})
+	}
 
-	stopChan := make(chan struct{}, 1)
-	readyChan := make(chan struct{})
+	pod, tier, err := findPod(ctx, clientSet, log, tunnel, tiers, *lastPod)
+	if err != nil {
+		discover.End(err)
+		return err
+	}
+	discover.SetAttribute("tier", tier)
+	discover.End(nil)
+	// The failover tiers are still looked up in all namespaces.
+	discovery := tunnel
+	if tunnel.Namespace == AllNamespaces {
+		log.Infof("Found pod %s in namespace %s.", pod.Name, pod.Namespace)
+		tunnel.Namespace = pod.Namespace
+		log.Namespace = pod.Namespace
+	}
+	podName := pod.Name
+	span.SetAttribute("pod", podName)
+	span.SetAttribute("node", pod.Spec.NodeName)
+	log = log.WithPod(podName)
+	if tier > *lastTier {
+		log.Warnf("No ready pods match %s, failing over to %s.", describeSelectors(tiers[*lastTier], tunnel.FieldSelector), describeSelectors(tiers[tier], tunnel.FieldSelector))
+	} else if tier < *lastTier {
+		log.Infof("Recovered, back to %s.", describeSelectors(tiers[tier], tunnel.FieldSelector))
+	}
+	newPod := podName != *lastPod
+	*lastPod, *lastTier = podName, tier
 
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
-	defer signal.Stop(signals)
+	var podPorts []int
+	for _, mapping := range tunnel.Ports {
+		if tunnel.Socks {
+			break
+		}
+		var podPort int
+		if service != nil {
+			podPort, err = servicePodPort(service, pod, mapping.Pod)
+		} else {
+			podPort, err = podPortNumber(pod, mapping.Pod)
+		}
+		if err != nil {
+			return err
+		}
+		if !containerPortDeclared(pod, podPort) {
+			if tunnel.StrictPorts {
+				return fmt.Errorf("Pod %s has no container port %d", podName, podPort)
+			}
+			if newPod {
+				log.Warnf("Pod %s has no container port %d, so connections to it may be refused.", podName, podPort)
+			}
+		}
+		podPorts = append(podPorts, podPort)
+	}
+
+	address := portForwardURL(clientSet, tunnel.Namespace, podName)
 
+	if fwd.protocol == ProtocolAuto && !tunnel.Socks {
+		conn, err := fwd.websocket.Dial(address, podPorts[0])
+		if err == nil {
+			conn.Close()
+			fwd.protocol = ProtocolWebSocket
+		} else {
+			log.Infof("Using SPDY since WebSocket didn't work: %s", err.Error())
+			fwd.protocol = ProtocolSPDY
+		}
+	}
+
+	// The relays accept the connections on the local ports. With SPDY, they
+	// connect to client-go's listeners on internal ports. With socks, every
+	// connection runs socat in the pod instead.
+	var ports, descriptions []string
+	dials := make([]dialFunc, len(tunnel.Ports))
+	for i, mapping := range tunnel.Ports {
+		if tunnel.Socks {
+			dials[i] = socksDial(clientSet, fwd, log, tunnel, podName)
+			descriptions = append(descriptions, fmt.Sprintf("SOCKS on %s through pod %s/%s", joinAddresses(tunnel.BindAddresses(mapping), strconv.Itoa(mapping.Local)), tunnel.Namespace, podName))
+			continue
+		}
+		podPort := podPorts[i]
+		if fwd.protocol == ProtocolWebSocket {
+			dials[i] = func(net.Conn) (io.ReadWriteCloser, error) {
+				return fwd.websocket.Dial(address, podPort)
+			}
+		} else {
+			internalPort, err := freePort(internalAddress)
+			if err != nil {
+				return err
+			}
+			dials[i] = dialTCP(net.JoinHostPort(internalAddress, strconv.Itoa(internalPort)))
+			ports = append(ports, fmt.Sprintf("%d:%d", internalPort, podPort))
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s to pod %s/%s:%d", joinAddresses(tunnel.BindAddresses(mapping), strconv.Itoa(mapping.Local)), tunnel.Namespace, podName, podPort))
+	}
+	start := func() {
+		for i, relay := range relays {
+			relay.setDial(dials[i])
+		}
+		logReady(log, tunnel, pod, relays, podPorts)
+		span.AddEvent("ready")
+		onReady(pod)
+	}
+	defer func() {
+		for _, relay := range relays {
+			relay.setDial(nil)
+		}
+	}()
+
+	log.Infof("Forwarding %s", strings.Join(descriptions, ", "))
+
+	// The session ends when the tunnel is stopped, when it is idle, when it
+	// reaches max_lifetime or when the pod disappears, in which case the
+	// caller reconnects to a fresh pod.
+	sessionCtx, endSession := gocontext.WithCancel(ctx)
+	defer endSession()
+	sessionStop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	var podGone, idle int32
 	go func() {
-		<-signals
-		if stopChan != nil {
-			fmt.Printf("[%s] Stopped forwarding %s:%d.\n", context, podName, tunnel.PodPort)
-			close(stopChan)
+		defer close(sessionStop)
+		if waitForPodGone(sessionCtx, clientSet, log, tunnel, podName, done) {
+			atomic.StoreInt32(&podGone, 1)
 		}
 	}()
+	if tunnel.IdleTimeout.Duration > 0 {
+		go func() {
+			if watchIdle(relays, tunnel.IdleTimeout.Duration, sessionStop) {
+				atomic.StoreInt32(&idle, 1)
+				endSession()
+			}
+		}()
+	}
+	var failback int32
+	if tier > 0 {
+		go func() {
+			if waitForFailback(sessionCtx, clientSet, discovery, tiers[:tier], done) {
+				log.Infof("Pods matching %s are ready again, switching back.", describeSelectors(tiers[0], tunnel.FieldSelector))
+				atomic.StoreInt32(&failback, 1)
+				endSession()
+			}
+		}()
+	}
+	var expired int32
+	if tunnel.MaxLifetime.Duration > 0 {
+		go func() {
+			timer := time.NewTimer(tunnel.MaxLifetime.Duration)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				log.Infof("The tunnel has been up for max_lifetime %s, reconnecting.", tunnel.MaxLifetime.Duration)
+				atomic.StoreInt32(&expired, 1)
+				endSession()
+			case <-sessionStop:
+			}
+		}()
+	}
+	sessionErr := func() error {
+		if atomic.LoadInt32(&podGone) == 1 {
+			return errPodGone
+		} else if atomic.LoadInt32(&idle) == 1 {
+			return errIdle
+		} else if atomic.LoadInt32(&failback) == 1 {
+			return errFailback
+		} else if atomic.LoadInt32(&expired) == 1 {
+			return errExpired
+		}
+		return nil
+	}
+
+	if fwd.protocol == ProtocolWebSocket || tunnel.Socks {
+		// Every connection gets its own WebSocket or exec, so there's
+		// nothing to wait for.
+		start()
+		<-sessionStop
+		return sessionErr()
+	}
+
+	address.RawQuery = url.Values{"timeout": {tunnel.DialTimeout.String()}}.Encode()
+	dialer := &recordingDialer{Dialer: spdy.NewDialer(fwd.upgrader, &http.Client{
+		Transport: fwd.transport,
+	}, "POST", address), log: log, url: address}
 
-	transport, upgrader, err := spdy.RoundTripperFor(cfg)
+	tag := fmt.Sprintf("%s:%d", podName, tunnel.Ports[0].Local)
+	out := &Logger{Log: log, Tag: tag}
+	errOut := &Logger{Log: log, Tag: tag, Err: true}
+
+	release, ok := connectSlots.Acquire(ctx, log)
+	if !ok {
+		return nil
+	}
+	defer release()
+	dial := StartSpan("dial", span)
+	dial.SetAttribute("protocol", fwd.protocol)
+	readyChan := make(chan struct{})
+	fw, err := portforward.NewOnAddresses(dialer, []string{internalAddress}, ports, sessionStop, readyChan, out, errOut)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err.Error())
-		os.Exit(1)
+		dial.End(err)
+		return err
+	}
+	// client-go can't be interrupted while it is connecting, so when that
+	// takes longer than dial_timeout, give up on it without waiting.
+	forwarded := make(chan error, 1)
+	go func() {
+		forwarded <- fw.ForwardPorts()
+	}()
+	timer := time.NewTimer(tunnel.DialTimeout.Duration)
+	defer timer.Stop()
+	select {
+	case <-readyChan:
+		timer.Stop()
+		release()
+		dial.End(nil)
+		start()
+		err = <-forwarded
+	case err = <-forwarded:
+		if isAuthError(dialer.err) {
+			err = dialer.err
+		}
+		dial.End(err)
+	case <-sessionStop:
+		dial.End(nil)
+		return sessionErr()
+	case <-timer.C:
+		err = fmt.Errorf("Timed out connecting to pod %s after %s", podName, tunnel.DialTimeout.Duration)
+		dial.End(err)
+		return err
 	}
+	if err == nil {
+		return sessionErr()
+	}
+	return err
+}
 
-	restClient := clientSet.RESTClient()
-	req := restClient.Post().
+// portForwardURL returns the URL to port forward to the pod, the same as
+// kubectl port-forward uses. The core API client's base path already has
+// /api/v1, after any path prefix in the server URL.
+func portForwardURL(clientSet kubernetes.Interface, namespace string, podName string) *url.URL {
+	return clientSet.CoreV1().RESTClient().Post().
 		Resource("pods").
-		Namespace(tunnel.Namespace).
+		Namespace(namespace).
 		Name(podName).
-		SubResource("portforward")
-
-	dialer := spdy.NewDialer(upgrader, &http.Client{
-		Transport: transport,
-	}, "POST", &url.URL{
-		Scheme:   req.URL().Scheme,
-		Host:     req.URL().Host,
-		Path:     "/api/v1" + req.URL().Path,
-		RawQuery: "timeout=10s",
-	})
+		SubResource("portforward").
+		URL()
+}
 
-	ports := []string{
-		fmt.Sprintf("%d:%d", tunnel.LocalPort, tunnel.PodPort),
+// logReady logs that the tunnel is ready, with the pod and the addresses that
+// the relays are listening on. This is the one line to look for.
+func logReady(log Log, tunnel Tunnel, pod *v1.Pod, relays []*relay, podPorts []int) {
+	var ports []string
+	for i, relay := range relays {
+		for _, address := range relay.addresses() {
+			if tunnel.Socks {
+				ports = append(ports, address+" (SOCKS)")
+			} else if tunnel.TLS != nil {
+				ports = append(ports, fmt.Sprintf("%s (TLS) -> %d", address, podPorts[i]))
+			} else {
+				ports = append(ports, fmt.Sprintf("%s -> %d", address, podPorts[i]))
+			}
+		}
 	}
-	logger := &Logger{
-		Context: context,
-		Tag:     fmt.Sprintf("%s:%d", podName, tunnel.LocalPort),
+	log.Node = pod.Spec.NodeName
+	description := ""
+	if tunnel.Description != "" {
+		description = fmt.Sprintf(" (%s)", tunnel.Description)
 	}
+	log.Eventf("Tunnel ready%s: %s/%s via pod %s on node %s: %s", description, tunnel.Namespace, tunnel.Target(), pod.Name, pod.Spec.NodeName, strings.Join(ports, ", "))
+}
 
-	fw, err := portforward.New(dialer, ports, stopChan, readyChan, logger, logger)
-	if err != nil {
-		panic(err.Error())
+// watchIdle returns true once none of the relays have had a connection for
+// timeout, or false when stop is closed.
+func watchIdle(relays []*relay, timeout time.Duration, stop <-chan struct{}) bool {
+	ticker := time.NewTicker(idleCheckInterval(timeout))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return false
+		case <-ticker.C:
+		}
+		idle := true
+		for _, relay := range relays {
+			if relay.idleFor() < timeout {
+				idle = false
+			}
+		}
+		if idle {
+			return true
+		}
 	}
+}
 
-	err = fw.ForwardPorts()
-	if err != nil {
-		panic(err.Error())
+func idleCheckInterval(timeout time.Duration) time.Duration {
+	if interval := timeout / 10; interval > time.Second {
+		return interval
 	}
+	return time.Second
 }
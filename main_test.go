@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestPortForwardURL(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"https://example.com:6443", "https://example.com:6443/api/v1/namespaces/ns/pods/pod-1/portforward"},
+		{"https://example.com:6443/", "https://example.com:6443/api/v1/namespaces/ns/pods/pod-1/portforward"},
+		{"https://example.com/k8s/clusters/c-123", "https://example.com/k8s/clusters/c-123/api/v1/namespaces/ns/pods/pod-1/portforward"},
+		{"http://127.0.0.1:8001", "http://127.0.0.1:8001/api/v1/namespaces/ns/pods/pod-1/portforward"},
+	}
+	for _, test := range tests {
+		clientSet, err := kubernetes.NewForConfig(&rest.Config{Host: test.host})
+		if err != nil {
+			t.Fatalf("%s: %s", test.host, err.Error())
+		}
+		if got := portForwardURL(clientSet, "ns", "pod-1").String(); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.host, got, test.want)
+		}
+	}
+}
+
+func TestFreeFanoutPort(t *testing.T) {
+	children := map[string]*fanoutChild{
+		"pod-0": {port: 65533},
+		"pod-1": {port: 65535},
+	}
+	if port, ok := freeFanoutPort(children, 65533); !ok || port != 65534 {
+		t.Errorf("got %d %t, want 65534 true", port, ok)
+	}
+	children["pod-2"] = &fanoutChild{port: 65534}
+	if port, ok := freeFanoutPort(children, 65533); ok {
+		t.Errorf("got %d %t, want no free port", port, ok)
+	}
+}
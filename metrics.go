@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics keeps track of the tunnels' health and serves it in the Prometheus
+// text format.
+type Metrics struct {
+	mutex   sync.Mutex
+	tunnels []*TunnelMetrics
+}
+
+type TunnelMetrics struct {
+	metrics     *Metrics
+	labels      string
+	up          bool
+	reconnects  int
+	connections int64
+	bytesUp     int64
+	bytesDown   int64
+}
+
+var metrics = &Metrics{}
+
+// Tunnel registers a tunnel and returns the handle used to update its metrics.
+// name is the tunnel's DisplayName, from before its auto ports were picked.
+// Only tunnels with a description get a description label.
+func (this *Metrics) Tunnel(context string, name string, tunnel Tunnel) *TunnelMetrics {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	t := &TunnelMetrics{
+		metrics: this,
+		labels: fmt.Sprintf(`name="%s",context="%s",selector="%s",local_port="%s"`,
+			escapeLabel(name), escapeLabel(context), escapeLabel(tunnel.Target()), localPorts(tunnel)),
+	}
+	if tunnel.Description != "" {
+		t.labels += fmt.Sprintf(`,description="%s"`, escapeLabel(tunnel.Description))
+	}
+	this.tunnels = append(this.tunnels, t)
+	return t
+}
+
+// Unregister removes the tunnel's metrics, e.g. when it was removed from the
+// config.
+func (this *TunnelMetrics) Unregister() {
+	this.metrics.mutex.Lock()
+	defer this.metrics.mutex.Unlock()
+	for i, t := range this.metrics.tunnels {
+		if t == this {
+			this.metrics.tunnels = append(this.metrics.tunnels[:i], this.metrics.tunnels[i+1:]...)
+			return
+		}
+	}
+}
+
+// localPorts returns the tunnel's local ports, separated by commas.
+func localPorts(tunnel Tunnel) string {
+	var ports []string
+	for _, mapping := range tunnel.PortMappings() {
+		ports = append(ports, strconv.Itoa(mapping.Local))
+	}
+	return strings.Join(ports, ",")
+}
+
+func (this *TunnelMetrics) SetUp(up bool) {
+	this.metrics.mutex.Lock()
+	defer this.metrics.mutex.Unlock()
+	this.up = up
+}
+
+func (this *TunnelMetrics) IncReconnects() {
+	this.metrics.mutex.Lock()
+	defer this.metrics.mutex.Unlock()
+	this.reconnects++
+}
+
+func (this *TunnelMetrics) AddConnection() {
+	this.metrics.mutex.Lock()
+	defer this.metrics.mutex.Unlock()
+	this.connections++
+}
+
+// AddBytes counts the bytes sent to the pod (up) and received from it (down).
+func (this *TunnelMetrics) AddBytes(up, down int64) {
+	this.metrics.mutex.Lock()
+	defer this.metrics.mutex.Unlock()
+	this.bytesUp += up
+	this.bytesDown += down
+}
+
+// Summary describes the traffic, like "42 connections, 1.3MB up / 5.7MB down".
+func (this *TunnelMetrics) Summary() string {
+	this.metrics.mutex.Lock()
+	defer this.metrics.mutex.Unlock()
+	return fmt.Sprintf("%d connections, %s up / %s down", this.connections, formatBytes(this.bytesUp), formatBytes(this.bytesDown))
+}
+
+func (this *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.mutex.Lock()
+	tunnels := make([]TunnelMetrics, len(this.tunnels))
+	for i, t := range this.tunnels {
+		tunnels[i] = *t
+	}
+	this.mutex.Unlock()
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].labels < tunnels[j].labels
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP kube_tunnel_up Whether the tunnel is currently forwarding.")
+	fmt.Fprintln(w, "# TYPE kube_tunnel_up gauge")
+	for _, t := range tunnels {
+		up := 0
+		if t.up {
+			up = 1
+		}
+		fmt.Fprintf(w, "kube_tunnel_up{%s} %d\n", t.labels, up)
+	}
+	fmt.Fprintln(w, "# HELP kube_tunnel_reconnects_total How many times the tunnel has been re-established.")
+	fmt.Fprintln(w, "# TYPE kube_tunnel_reconnects_total counter")
+	for _, t := range tunnels {
+		fmt.Fprintf(w, "kube_tunnel_reconnects_total{%s} %d\n", t.labels, t.reconnects)
+	}
+	fmt.Fprintln(w, "# HELP kube_tunnel_connections_total How many connections the tunnel has forwarded.")
+	fmt.Fprintln(w, "# TYPE kube_tunnel_connections_total counter")
+	for _, t := range tunnels {
+		fmt.Fprintf(w, "kube_tunnel_connections_total{%s} %d\n", t.labels, t.connections)
+	}
+	fmt.Fprintln(w, "# HELP kube_tunnel_bytes_forwarded_total How many bytes the tunnel has forwarded, up to the pod or down from it.")
+	fmt.Fprintln(w, "# TYPE kube_tunnel_bytes_forwarded_total counter")
+	for _, t := range tunnels {
+		fmt.Fprintf(w, "kube_tunnel_bytes_forwarded_total{%s,direction=\"up\"} %d\n", t.labels, t.bytesUp)
+		fmt.Fprintf(w, "kube_tunnel_bytes_forwarded_total{%s,direction=\"down\"} %d\n", t.labels, t.bytesDown)
+	}
+}
+
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+// StartMetricsServer serves /metrics on addr in the background.
+func StartMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	go func() {
+		Log{}.Infof("Serving metrics on %s.", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			Log{}.Errorf("Metrics server failed: %s", err.Error())
+		}
+	}()
+	return server
+}
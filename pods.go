@@ -0,0 +1,707 @@
+package main
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	errNoPods   = errors.New("No pods found")
+	errPodGone  = errors.New("Pod is gone")
+	errIdle     = errors.New("Tunnel is idle")
+	errFailback = errors.New("Failing back")
+	errExpired  = errors.New("Tunnel reached max_lifetime")
+	errGaveUp   = errors.New("Tunnel reached max_reconnects")
+)
+
+const readyPollInterval = 2 * time.Second
+
+// waitProgressInterval is how often findPod logs that it is still waiting for
+// a pod.
+const waitProgressInterval = 5 * time.Second
+
+// resolveSelector returns the label selectors for the tunnel's pods, which
+// match a pod if any of them do. For services and workloads it is their
+// selector, and the service is returned too.
+func resolveSelector(ctx gocontext.Context, clientSet kubernetes.Interface, tunnel Tunnel) ([]string, *v1.Service, error) {
+	if tunnel.Resource != "" {
+		selector, err := resolveWorkload(ctx, clientSet, tunnel)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{selector}, nil, nil
+	}
+	if tunnel.Service == "" {
+		if len(tunnel.Selector) == 0 {
+			return []string{""}, nil, nil
+		}
+		return tunnel.Selector, nil, nil
+	}
+	service := &v1.Service{}
+	if err := getObject(ctx, clientSet.CoreV1().RESTClient(), tunnel, "services", tunnel.Service, service); err != nil {
+		return nil, nil, err
+	}
+	if len(service.Spec.Selector) == 0 {
+		return nil, nil, fmt.Errorf("Service %s has no selector", tunnel.Service)
+	}
+	return []string{labels.SelectorFromSet(service.Spec.Selector).String()}, service, nil
+}
+
+// workloadKinds maps the kinds that resource accepts, and their short names,
+// to their API resource.
+var workloadKinds = map[string]string{
+	"deployment":             "deployments",
+	"deployments":            "deployments",
+	"deploy":                 "deployments",
+	"statefulset":            "statefulsets",
+	"statefulsets":           "statefulsets",
+	"sts":                    "statefulsets",
+	"daemonset":              "daemonsets",
+	"daemonsets":             "daemonsets",
+	"ds":                     "daemonsets",
+	"replicaset":             "replicasets",
+	"replicasets":            "replicasets",
+	"rs":                     "replicasets",
+	"replicationcontroller":  "replicationcontrollers",
+	"replicationcontrollers": "replicationcontrollers",
+	"rc":                     "replicationcontrollers",
+}
+
+// parseResource splits a resource like "deployment/my-app" into its API
+// resource and name.
+func parseResource(resource string) (string, string, error) {
+	parts := strings.SplitN(resource, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", errors.New("must be <kind>/<name>, like deployment/my-app")
+	}
+	kind, ok := workloadKinds[strings.ToLower(parts[0])]
+	if !ok {
+		return "", "", fmt.Errorf("unsupported kind %s, use deployment, statefulset, daemonset, replicaset or replicationcontroller", parts[0])
+	}
+	return kind, parts[1], nil
+}
+
+// resolveWorkload looks up the tunnel's resource and returns its pod
+// selector.
+func resolveWorkload(ctx gocontext.Context, clientSet kubernetes.Interface, tunnel Tunnel) (string, error) {
+	kind, name, err := parseResource(tunnel.Resource)
+	if err != nil {
+		return "", err
+	}
+	var selector *metav1.LabelSelector
+	switch kind {
+	case "deployments":
+		deployment := &appsv1.Deployment{}
+		err = getObject(ctx, clientSet.AppsV1().RESTClient(), tunnel, kind, name, deployment)
+		selector = deployment.Spec.Selector
+	case "statefulsets":
+		statefulSet := &appsv1.StatefulSet{}
+		err = getObject(ctx, clientSet.AppsV1().RESTClient(), tunnel, kind, name, statefulSet)
+		selector = statefulSet.Spec.Selector
+	case "daemonsets":
+		daemonSet := &appsv1.DaemonSet{}
+		err = getObject(ctx, clientSet.AppsV1().RESTClient(), tunnel, kind, name, daemonSet)
+		selector = daemonSet.Spec.Selector
+	case "replicasets":
+		replicaSet := &appsv1.ReplicaSet{}
+		err = getObject(ctx, clientSet.AppsV1().RESTClient(), tunnel, kind, name, replicaSet)
+		selector = replicaSet.Spec.Selector
+	case "replicationcontrollers":
+		controller := &v1.ReplicationController{}
+		err = getObject(ctx, clientSet.CoreV1().RESTClient(), tunnel, kind, name, controller)
+		selector = &metav1.LabelSelector{MatchLabels: controller.Spec.Selector}
+	}
+	if err != nil {
+		return "", err
+	}
+	if selector == nil || len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0 {
+		return "", fmt.Errorf("%s has no selector", tunnel.Resource)
+	}
+	parsed, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return "", fmt.Errorf("%s has an invalid selector: %s", tunnel.Resource, err.Error())
+	}
+	return parsed.String(), nil
+}
+
+// getObject gets the named object in the tunnel's namespace into into,
+// retrying transient errors and giving up after discovery_timeout.
+func getObject(ctx gocontext.Context, client rest.Interface, tunnel Tunnel, resource string, name string, into runtime.Object) error {
+	return retryTransient(ctx, func() error {
+		ctx, cancel := gocontext.WithTimeout(ctx, tunnel.DiscoveryTimeout.Duration)
+		defer cancel()
+		return client.Get().
+			Namespace(tunnel.Namespace).
+			Resource(resource).
+			Name(name).
+			Context(ctx).
+			Do().
+			Into(into)
+	})
+}
+
+// listSelectorPods lists the pods that match any of the selectors and the
+// tunnel's field selector, without duplicates. For a tunnel with a pod, it is
+// that pod, or none if it doesn't exist.
+func listSelectorPods(ctx gocontext.Context, clientSet kubernetes.Interface, tunnel Tunnel, selectors []string) ([]v1.Pod, error) {
+	if tunnel.Pod != "" {
+		var pod *v1.Pod
+		err := retryTransient(ctx, func() error {
+			var err error
+			pod, err = getPod(ctx, clientSet, tunnel, tunnel.Pod)
+			return err
+		})
+		if k8serrors.IsNotFound(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return []v1.Pod{*pod}, nil
+	}
+	var pods []v1.Pod
+	seen := make(map[string]bool)
+	for _, selector := range selectors {
+		var list *v1.PodList
+		namespace := tunnel.Namespace
+		if namespace == AllNamespaces {
+			namespace = metav1.NamespaceAll
+		}
+		err := retryTransient(ctx, func() error {
+			listCtx, cancel := gocontext.WithTimeout(ctx, tunnel.DiscoveryTimeout.Duration)
+			defer cancel()
+			var err error
+			list, err = listPods(listCtx, clientSet, namespace, metav1.ListOptions{
+				LabelSelector: selector,
+				FieldSelector: tunnel.FieldSelector,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range list.Items {
+			// With namespace = "*", pods in different namespaces can have
+			// the same name.
+			key := pod.Namespace + "/" + pod.Name
+			if !seen[key] {
+				seen[key] = true
+				pods = append(pods, pod)
+			}
+		}
+	}
+	return pods, nil
+}
+
+// How many times, and how quickly, requests that fail with a transient error
+// are retried before giving up.
+const (
+	transientRetries  = 3
+	transientRetryMin = 500 * time.Millisecond
+	transientRetryMax = 5 * time.Second
+)
+
+// retryTransient calls f until it succeeds, fails with an error that isn't
+// transient, or has been retried transientRetries times.
+func retryTransient(ctx gocontext.Context, f func() error) error {
+	backoff := &Backoff{Min: transientRetryMin, Max: transientRetryMax}
+	for retry := 0; ; retry++ {
+		err := f()
+		if err == nil || retry == transientRetries || ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+// isTransient returns true for errors that are likely to go away on their
+// own, like timeouts, throttling and the API server being briefly
+// unreachable.
+func isTransient(err error) bool {
+	if k8serrors.IsServerTimeout(err) || k8serrors.IsTimeout(err) || k8serrors.IsTooManyRequests(err) || k8serrors.IsServiceUnavailable(err) || k8serrors.IsInternalError(err) {
+		return true
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	if _, ok := err.(*net.OpError); ok {
+		return true
+	}
+	return err == gocontext.DeadlineExceeded || utilnet.IsProbableEOF(err)
+}
+
+// isPermanent returns true for errors that retrying won't fix, like missing
+// permissions or a service that doesn't exist.
+func isPermanent(err error) bool {
+	return k8serrors.IsForbidden(err) || k8serrors.IsUnauthorized(err) || k8serrors.IsNotFound(err)
+}
+
+// isAuthError returns true when the API server rejected the credentials, or
+// they could not be fetched, e.g. because an exec plugin failed.
+func isAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return k8serrors.IsUnauthorized(err) || strings.Contains(err.Error(), "getting credentials: ")
+}
+
+// credentialsError explains an auth error from the context.
+func credentialsError(context string, err error) error {
+	return fmt.Errorf("The credentials for context %s are expired or invalid (%s). Refresh them, e.g. by running kubectl --context %s get pods.", context, err.Error(), context)
+}
+
+// findPod lists the pods matching the selectors and picks one of them with
+// PickPod. tiers holds the tunnel's selectors followed by its failover
+// selectors, and a pod is picked from the first tier that has ready pods. The
+// tier is returned with the pod. With wait_for_pod, the selectors are retried
+// every discovery_retry_interval until they match a pod. With
+// wait_for_ready, the selectors are polled until they match a ready pod.
+// Waiting for a pod or for it to be ready gives up after ready_timeout in
+// total, and the progress is logged every waitProgressInterval.
+func findPod(ctx gocontext.Context, clientSet kubernetes.Interface, log Log, tunnel Tunnel, tiers [][]string, lastPod string) (*v1.Pod, int, error) {
+	started := time.Now()
+	deadline := started.Add(tunnel.ReadyTimeout.Duration)
+	var lastProgress time.Time
+	// progress logs how the wait is going when it's been a while since the
+	// last time.
+	progress := func(format string, a ...interface{}) {
+		if time.Since(lastProgress) < waitProgressInterval {
+			return
+		}
+		lastProgress = time.Now()
+		log.Infof("%s (waited %s of ready_timeout %s).", fmt.Sprintf(format, a...), time.Since(started).Round(time.Second), tunnel.ReadyTimeout.Duration)
+	}
+	for {
+		found := 0
+		// The pods that aren't ready, with the reason.
+		var notReady []string
+		for tier, selectors := range tiers {
+			release, ok := connectSlots.Acquire(ctx, log)
+			if !ok {
+				return nil, 0, errors.New("Stopped while waiting to look up the pods")
+			}
+			pods, err := listSelectorPods(ctx, clientSet, tunnel, selectors)
+			release()
+			if err != nil {
+				return nil, 0, err
+			}
+			found += len(pods)
+			if len(pods) < 1 {
+				continue
+			}
+			pod, skipped, err := PickPod(pods, tunnel, lastPod)
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, reason := range skipped {
+				log.Debugf("Skipping pod %s.", reason)
+			}
+			notReady = append(notReady, skipped...)
+			if pod == nil {
+				continue
+			}
+			if tunnel.Sticky && lastPod != "" {
+				if pod.Name == lastPod {
+					log.WithPod(lastPod).Infof("Reusing pod %s.", lastPod)
+					return pod, tier, nil
+				}
+				log.Infof("Pod %s is no longer available, picking a new pod.", lastPod)
+			}
+			if tunnel.Select != "" {
+				log.WithPod(pod.Name).Infof("Selected the %s ready pod %s (age %s).", tunnel.Select, pod.Name, podAge(pod))
+			} else if tunnel.ReadyPodsOnly() {
+				log.WithPod(pod.Name).Infof("Selected pod %s since it is ready.", pod.Name)
+			}
+			return pod, tier, nil
+		}
+
+		if found < 1 {
+			if !tunnel.WaitForPod {
+				return nil, 0, errNoPods
+			}
+			if time.Now().After(deadline) {
+				return nil, 0, fmt.Errorf("No pods found for %s after %s", tunnel.Target(), tunnel.ReadyTimeout.Duration)
+			}
+			progress("No pods found for %s yet, checking again every %s", tunnel.Target(), tunnel.DiscoveryRetryInterval.Duration)
+			select {
+			case <-ctx.Done():
+				return nil, 0, errors.New("Stopped while waiting for a pod")
+			case <-time.After(tunnel.DiscoveryRetryInterval.Duration):
+			}
+			continue
+		}
+		if !tunnel.WaitForReady {
+			return nil, 0, fmt.Errorf("No ready pods found for %s: %s", tunnel.Target(), strings.Join(notReady, ", "))
+		}
+		if time.Now().After(deadline) {
+			return nil, 0, fmt.Errorf("No ready pods found for %s after %s: %s", tunnel.Target(), tunnel.ReadyTimeout.Duration, strings.Join(notReady, ", "))
+		}
+		progress("Still waiting for a ready pod for %s, %d pods are not ready: %s", tunnel.Target(), len(notReady), strings.Join(notReady, ", "))
+		select {
+		case <-ctx.Done():
+			return nil, 0, errors.New("Stopped while waiting for a ready pod")
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// hasReadyPods returns true if any of the tiers has a ready pod.
+func hasReadyPods(ctx gocontext.Context, clientSet kubernetes.Interface, tunnel Tunnel, tiers [][]string) bool {
+	for _, selectors := range tiers {
+		pods, err := listSelectorPods(ctx, clientSet, tunnel, selectors)
+		if err != nil {
+			return false
+		}
+		for _, pod := range pods {
+			if podNotReadyReason(&pod) == "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// waitForFailback blocks until one of the tiers has a ready pod, in which
+// case it returns true, or until ctx is cancelled or done is closed. It checks
+// every reconnect_interval.
+func waitForFailback(ctx gocontext.Context, clientSet kubernetes.Interface, tunnel Tunnel, tiers [][]string, done <-chan struct{}) bool {
+	ticker := time.NewTicker(tunnel.ReconnectInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-done:
+			return false
+		case <-ticker.C:
+			if hasReadyPods(ctx, clientSet, tunnel, tiers) {
+				return true
+			}
+		}
+	}
+}
+
+// PickPod picks the pod to forward to out of the pods that the selectors of
+// one tier matched, with lastPod being the pod of the previous session.
+// Terminating pods are never picked. With ReadyPodsOnly, pods that aren't
+// ready are skipped, and they are returned with the reason, along with a nil
+// pod if none are ready. With sticky, lastPod is reused while it is ready,
+// and otherwise the pod is picked by selectPod. It is an error if all pods
+// are terminating, or if the ready pods are in several namespaces without
+// select. It doesn't log or call the API, so that it is easy to test.
+func PickPod(pods []v1.Pod, tunnel Tunnel, lastPod string) (*v1.Pod, []string, error) {
+	var candidates []v1.Pod
+	var skipped []string
+	for _, pod := range pods {
+		if tunnel.ReadyPodsOnly() {
+			if reason := podNotReadyReason(&pod); reason != "" {
+				skipped = append(skipped, fmt.Sprintf("%s (%s)", pod.Name, reason))
+				continue
+			}
+		} else if pod.DeletionTimestamp != nil {
+			// Never pick a pod that is on its way out.
+			continue
+		}
+		candidates = append(candidates, pod)
+	}
+	if len(candidates) < 1 {
+		if !tunnel.ReadyPodsOnly() && len(pods) > 0 {
+			return nil, nil, fmt.Errorf("All pods for %s are terminating", tunnel.Target())
+		}
+		return nil, skipped, nil
+	}
+	if tunnel.Namespace == AllNamespaces && tunnel.Select == "" {
+		if namespaces := podNamespaces(candidates); len(namespaces) > 1 {
+			return nil, skipped, fmt.Errorf("The ready pods for %s are in several namespaces (%s), set namespace or select to pick one", tunnel.Target(), strings.Join(namespaces, ", "))
+		}
+	}
+	if pod := stickyPod(candidates, tunnel, lastPod); pod != nil {
+		return pod, skipped, nil
+	}
+	return selectPod(candidates, tunnel, lastPod), skipped, nil
+}
+
+// podNamespaces returns the sorted namespaces of the pods.
+func podNamespaces(pods []v1.Pod) []string {
+	seen := make(map[string]bool)
+	var namespaces []string
+	for _, pod := range pods {
+		if !seen[pod.Namespace] {
+			seen[pod.Namespace] = true
+			namespaces = append(namespaces, pod.Namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// stickyPod returns lastPod if sticky is set and it is still one of the
+// candidates and ready. Otherwise it returns nil, and a new pod is picked.
+func stickyPod(pods []v1.Pod, tunnel Tunnel, lastPod string) *v1.Pod {
+	if !tunnel.Sticky || lastPod == "" {
+		return nil
+	}
+	for i := range pods {
+		if pods[i].Name == lastPod && podNotReadyReason(&pods[i]) == "" {
+			return &pods[i]
+		}
+	}
+	return nil
+}
+
+// selectPod picks one of the candidate pods. By default that is the first
+// one, with select it is the newest or oldest one, and in round-robin mode
+// it is the one that comes after lastPod when sorted by name.
+func selectPod(pods []v1.Pod, tunnel Tunnel, lastPod string) *v1.Pod {
+	if tunnel.Select != "" {
+		pod := &pods[0]
+		for i := range pods {
+			created := pods[i].CreationTimestamp.Time
+			if tunnel.Select == SelectNewest && created.After(pod.CreationTimestamp.Time) ||
+				tunnel.Select == SelectOldest && created.Before(pod.CreationTimestamp.Time) {
+				pod = &pods[i]
+			}
+		}
+		return pod
+	}
+	if tunnel.Mode != ModeRoundRobin {
+		return &pods[0]
+	}
+	sorted := make([]v1.Pod, len(pods))
+	copy(sorted, pods)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	for i := range sorted {
+		if sorted[i].Name > lastPod {
+			return &sorted[i]
+		}
+	}
+	return &sorted[0]
+}
+
+func podAge(pod *v1.Pod) time.Duration {
+	return time.Since(pod.CreationTimestamp.Time).Round(time.Second)
+}
+
+// listPods is the same as clientSet.CoreV1().Pods(namespace).List(opts), but
+// can be cancelled through ctx. The typed clients in this version of
+// client-go don't take a context.
+func listPods(ctx gocontext.Context, clientSet kubernetes.Interface, namespace string, opts metav1.ListOptions) (*v1.PodList, error) {
+	if !hasRESTClient(clientSet) {
+		return clientSet.CoreV1().Pods(namespace).List(opts)
+	}
+	pods := &v1.PodList{}
+	err := clientSet.CoreV1().RESTClient().Get().
+		Namespace(namespace).
+		Resource("pods").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Context(ctx).
+		Do().
+		Into(pods)
+	return pods, err
+}
+
+// getPod is the same as clientSet.CoreV1().Pods(namespace).Get(name), but
+// gives up after discovery_timeout.
+func getPod(ctx gocontext.Context, clientSet kubernetes.Interface, tunnel Tunnel, name string) (*v1.Pod, error) {
+	if !hasRESTClient(clientSet) {
+		return clientSet.CoreV1().Pods(tunnel.Namespace).Get(name, metav1.GetOptions{})
+	}
+	ctx, cancel := gocontext.WithTimeout(ctx, tunnel.DiscoveryTimeout.Duration)
+	defer cancel()
+	pod := &v1.Pod{}
+	err := clientSet.CoreV1().RESTClient().Get().
+		Namespace(tunnel.Namespace).
+		Resource("pods").
+		Name(name).
+		Context(ctx).
+		Do().
+		Into(pod)
+	return pod, err
+}
+
+// hasRESTClient returns false for the fake clientset in the tests, which has
+// no REST client to make requests with, so the typed client is used instead.
+func hasRESTClient(clientSet kubernetes.Interface) bool {
+	client, ok := clientSet.CoreV1().RESTClient().(*rest.RESTClient)
+	return ok && client != nil
+}
+
+// podNotReadyReason returns why the pod can't accept connections yet, or an
+// empty string if it is ready.
+func podNotReadyReason(pod *v1.Pod) string {
+	if pod.DeletionTimestamp != nil {
+		return "it is terminating"
+	}
+	if pod.Status.Phase != v1.PodRunning {
+		return fmt.Sprintf("phase is %s", pod.Status.Phase)
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if !status.Ready {
+			return fmt.Sprintf("container %s is not ready", status.Name)
+		}
+	}
+	return ""
+}
+
+// podPortNumber resolves a named pod port using the pod's container ports.
+func podPortNumber(pod *v1.Pod, port NamedPort) (int, error) {
+	if port.Name == "" {
+		return port.Number, nil
+	}
+	if containerPort, ok := containerPortByName(pod, port.Name); ok {
+		return containerPort, nil
+	}
+	return 0, fmt.Errorf("Pod %s has no container port named %s", pod.Name, port.Name)
+}
+
+// servicePodPort translates a service port to the port on the pod that it
+// targets, resolving named target ports using the pod's container ports.
+// UDP ports are skipped, e.g. for DNS services that have both.
+func servicePodPort(service *v1.Service, pod *v1.Pod, port NamedPort) (int, error) {
+	udp := false
+	for _, servicePort := range service.Spec.Ports {
+		if port.Name != "" && servicePort.Name != port.Name {
+			continue
+		} else if port.Name == "" && int(servicePort.Port) != port.Number {
+			continue
+		}
+		if servicePort.Protocol == v1.ProtocolUDP {
+			udp = true
+			continue
+		}
+		targetPort := servicePort.TargetPort
+		if targetPort.Type == intstr.Int {
+			if targetPort.IntVal == 0 {
+				return int(servicePort.Port), nil
+			}
+			return int(targetPort.IntVal), nil
+		}
+		if containerPort, ok := containerPortByName(pod, targetPort.StrVal); ok {
+			return containerPort, nil
+		}
+		return 0, fmt.Errorf("Pod %s has no container port named %s", pod.Name, targetPort.StrVal)
+	}
+	if udp {
+		return 0, fmt.Errorf("Service %s port %s is UDP, which isn't supported: %s", service.Name, port, errUDP)
+	}
+	return 0, fmt.Errorf("Service %s has no port %s", service.Name, port)
+}
+
+// containerPortDeclared returns true if any of the pod's containers declares
+// port. Pods can listen on ports they don't declare, so this is only a hint.
+func containerPortDeclared(pod *v1.Pod, port int) bool {
+	for _, container := range pod.Spec.Containers {
+		for _, containerPort := range container.Ports {
+			if int(containerPort.ContainerPort) == port {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containerPortByName(pod *v1.Pod, name string) (int, bool) {
+	for _, container := range pod.Spec.Containers {
+		for _, containerPort := range container.Ports {
+			if containerPort.Name == name {
+				return int(containerPort.ContainerPort), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// waitForPodGone blocks until the pod is deleted or starts terminating, in
+// which case it returns true, or until ctx is cancelled or done is closed.
+// With watch, the pods are watched so that this is noticed right away,
+// otherwise the pod is checked every reconnect_interval.
+func waitForPodGone(ctx gocontext.Context, clientSet kubernetes.Interface, log Log, tunnel Tunnel, podName string, done <-chan struct{}) bool {
+	for tunnel.Watch {
+		watcher, err := clientSet.CoreV1().Pods(tunnel.Namespace).Watch(metav1.ListOptions{
+			FieldSelector: "metadata.name=" + podName,
+		})
+		if err != nil {
+			log.Warnf("Could not watch pods, checking pod %s every %s instead: %s", podName, tunnel.ReconnectInterval.Duration, err.Error())
+			break
+		}
+		gone, stopped := watchForPodGone(watcher, log, podName, ctx.Done(), done)
+		watcher.Stop()
+		if gone || stopped {
+			return gone
+		}
+		// The watch timed out, start a new one.
+	}
+
+	ticker := time.NewTicker(tunnel.ReconnectInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-done:
+			return false
+		case <-ticker.C:
+			pod, err := getPod(ctx, clientSet, tunnel, podName)
+			if k8serrors.IsNotFound(err) {
+				log.Infof("Pod %s is gone.", podName)
+				return true
+			} else if err == nil && pod.DeletionTimestamp != nil {
+				log.Infof("Pod %s is terminating.", podName)
+				return true
+			}
+		}
+	}
+}
+
+func watchForPodGone(watcher watch.Interface, log Log, podName string, stopChan <-chan struct{}, done <-chan struct{}) (gone bool, stopped bool) {
+	for {
+		select {
+		case <-stopChan:
+			return false, true
+		case <-done:
+			return false, true
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return false, false
+			}
+			pod, ok := event.Object.(*v1.Pod)
+			if !ok || pod.Name != podName {
+				continue
+			}
+			if event.Type == watch.Deleted {
+				log.Infof("Pod %s was deleted.", podName)
+				return true, false
+			} else if pod.DeletionTimestamp != nil {
+				log.Infof("Pod %s is terminating.", podName)
+				return true, false
+			}
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	gocontext "context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var podEpoch = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testPod returns a running pod with the label app=api, that was created
+// age minutes after podEpoch. The options change it, e.g. to not be ready.
+func testPod(name string, age int, options ...func(*v1.Pod)) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "team",
+			Labels:            map[string]string{"app": "api"},
+			CreationTimestamp: metav1.NewTime(podEpoch.Add(time.Duration(age) * time.Minute)),
+		},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "c", Ready: true},
+			},
+		},
+	}
+	for _, option := range options {
+		option(pod)
+	}
+	return pod
+}
+
+func notReady(pod *v1.Pod) {
+	pod.Status.ContainerStatuses[0].Ready = false
+}
+
+func pending(pod *v1.Pod) {
+	pod.Status.Phase = v1.PodPending
+}
+
+func terminating(pod *v1.Pod) {
+	now := metav1.NewTime(podEpoch)
+	pod.DeletionTimestamp = &now
+}
+
+func otherApp(pod *v1.Pod) {
+	pod.Labels["app"] = "web"
+}
+
+func inProd(pod *v1.Pod) {
+	pod.Namespace = "prod"
+}
+
+func onNode(node string) func(*v1.Pod) {
+	return func(pod *v1.Pod) {
+		pod.Spec.NodeName = node
+	}
+}
+
+// testClientSet returns a fake clientset with the given pods. Unlike the API
+// server, the fake one ignores field selectors, so they are applied here for
+// the fields that the tests use.
+func testClientSet(pods ...*v1.Pod) *fake.Clientset {
+	objects := make([]runtime.Object, len(pods))
+	for i, pod := range pods {
+		objects[i] = pod
+	}
+	clientSet := fake.NewSimpleClientset(objects...)
+	clientSet.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		restrictions := action.(k8stesting.ListAction).GetListRestrictions()
+		if restrictions.Fields == nil || restrictions.Fields.Empty() {
+			return false, nil, nil
+		}
+		list := &v1.PodList{}
+		for _, pod := range pods {
+			namespace := action.GetNamespace()
+			if namespace != metav1.NamespaceAll && pod.Namespace != namespace {
+				continue
+			}
+			if restrictions.Fields.Matches(fields.Set{"metadata.name": pod.Name, "spec.nodeName": pod.Spec.NodeName}) {
+				list.Items = append(list.Items, *pod)
+			}
+		}
+		return true, list, nil
+	})
+	return clientSet
+}
+
+// testTunnel returns a tunnel in the namespace team with the selector app=api
+// and the defaults that findPod needs.
+func testTunnel(tunnel Tunnel) Tunnel {
+	if tunnel.Namespace == "" {
+		tunnel.Namespace = "team"
+	}
+	if len(tunnel.Selector) == 0 {
+		tunnel.Selector = StringList{"app=api"}
+	}
+	if tunnel.DiscoveryTimeout.Duration == 0 {
+		tunnel.DiscoveryTimeout.Duration = time.Second
+	}
+	if tunnel.DiscoveryRetryInterval.Duration == 0 {
+		tunnel.DiscoveryRetryInterval.Duration = 10 * time.Millisecond
+	}
+	if tunnel.ReadyTimeout.Duration == 0 {
+		tunnel.ReadyTimeout.Duration = time.Second
+	}
+	return tunnel
+}
+
+// listTestPods lists the pods that the tunnel's selectors match from a fake
+// clientset with the given pods, like findPod does for a tier.
+func listTestPods(t *testing.T, tunnel Tunnel, pods ...*v1.Pod) []v1.Pod {
+	list, err := listSelectorPods(gocontext.Background(), testClientSet(pods...), tunnel, tunnel.Selector)
+	if err != nil {
+		t.Fatalf("listSelectorPods: %s", err.Error())
+	}
+	return list
+}
+
+func TestPickPod(t *testing.T) {
+	tests := []struct {
+		name    string
+		tunnel  Tunnel
+		pods    []*v1.Pod
+		lastPod string
+		want    string
+		skipped []string
+		err     string
+	}{
+		{
+			name: "first pod",
+			pods: []*v1.Pod{testPod("api-1", 0), testPod("api-2", 1)},
+			want: "api-1",
+		},
+		{
+			name: "only matching pods",
+			pods: []*v1.Pod{testPod("web-1", 0, otherApp), testPod("api-2", 1)},
+			want: "api-2",
+		},
+		{
+			name: "not ready pods without wait_for_ready",
+			pods: []*v1.Pod{testPod("api-1", 0, notReady), testPod("api-2", 1)},
+			want: "api-1",
+		},
+		{
+			name: "never terminating pods",
+			pods: []*v1.Pod{testPod("api-1", 0, terminating), testPod("api-2", 1)},
+			want: "api-2",
+		},
+		{
+			name: "all terminating",
+			pods: []*v1.Pod{testPod("api-1", 0, terminating)},
+			err:  "All pods for app=api are terminating",
+		},
+		{
+			name:    "wait_for_ready",
+			tunnel:  Tunnel{WaitForReady: true},
+			pods:    []*v1.Pod{testPod("api-1", 0, notReady), testPod("api-2", 1, pending), testPod("api-3", 2)},
+			want:    "api-3",
+			skipped: []string{"api-1 (container c is not ready)", "api-2 (phase is Pending)"},
+		},
+		{
+			name:    "wait_for_ready without ready pods",
+			tunnel:  Tunnel{WaitForReady: true},
+			pods:    []*v1.Pod{testPod("api-1", 0, notReady), testPod("api-2", 1, terminating)},
+			skipped: []string{"api-1 (container c is not ready)", "api-2 (it is terminating)"},
+		},
+		{
+			name:   "newest",
+			tunnel: Tunnel{Select: SelectNewest},
+			pods:   []*v1.Pod{testPod("api-1", 5), testPod("api-2", 9), testPod("api-3", 9, notReady), testPod("api-4", 1)},
+			want:   "api-2",
+			skipped: []string{
+				"api-3 (container c is not ready)",
+			},
+		},
+		{
+			name:   "oldest",
+			tunnel: Tunnel{Select: SelectOldest},
+			pods:   []*v1.Pod{testPod("api-1", 5), testPod("api-2", 9), testPod("api-4", 1)},
+			want:   "api-4",
+		},
+		{
+			name:    "round-robin",
+			tunnel:  Tunnel{Mode: ModeRoundRobin},
+			pods:    []*v1.Pod{testPod("api-3", 0), testPod("api-1", 1), testPod("api-2", 2)},
+			lastPod: "api-1",
+			want:    "api-2",
+		},
+		{
+			name:    "round-robin wraps around",
+			tunnel:  Tunnel{Mode: ModeRoundRobin},
+			pods:    []*v1.Pod{testPod("api-3", 0), testPod("api-1", 1), testPod("api-2", 2)},
+			lastPod: "api-3",
+			want:    "api-1",
+		},
+		{
+			name:    "round-robin skips not ready pods",
+			tunnel:  Tunnel{Mode: ModeRoundRobin},
+			pods:    []*v1.Pod{testPod("api-1", 0), testPod("api-2", 1, notReady), testPod("api-3", 2)},
+			lastPod: "api-1",
+			want:    "api-3",
+			skipped: []string{"api-2 (container c is not ready)"},
+		},
+		{
+			name:   "all namespaces",
+			tunnel: Tunnel{Namespace: AllNamespaces},
+			pods:   []*v1.Pod{testPod("api-1", 0, inProd, notReady), testPod("api-2", 1, inProd)},
+			want:   "api-2",
+			skipped: []string{
+				"api-1 (container c is not ready)",
+			},
+		},
+		{
+			name:   "all namespaces is ambiguous",
+			tunnel: Tunnel{Namespace: AllNamespaces},
+			pods:   []*v1.Pod{testPod("api-1", 0), testPod("api-2", 1, inProd)},
+			err:    "The ready pods for app=api are in several namespaces (prod, team), set namespace or select to pick one",
+		},
+		{
+			name:   "all namespaces with the same pod name",
+			tunnel: Tunnel{Namespace: AllNamespaces},
+			pods:   []*v1.Pod{testPod("api-0", 0), testPod("api-0", 1, inProd)},
+			err:    "The ready pods for app=api are in several namespaces (prod, team), set namespace or select to pick one",
+		},
+		{
+			name:   "all namespaces with select",
+			tunnel: Tunnel{Namespace: AllNamespaces, Select: SelectOldest},
+			pods:   []*v1.Pod{testPod("api-1", 3), testPod("api-2", 1, inProd)},
+			want:   "api-2",
+		},
+		{
+			name:    "sticky",
+			tunnel:  Tunnel{Sticky: true},
+			pods:    []*v1.Pod{testPod("api-1", 0), testPod("api-2", 1)},
+			lastPod: "api-2",
+			want:    "api-2",
+		},
+		{
+			name:    "sticky pod is not ready",
+			tunnel:  Tunnel{Sticky: true},
+			pods:    []*v1.Pod{testPod("api-1", 0), testPod("api-2", 1, notReady)},
+			lastPod: "api-2",
+			want:    "api-1",
+		},
+		{
+			name:    "sticky pod is gone",
+			tunnel:  Tunnel{Sticky: true, Select: SelectNewest},
+			pods:    []*v1.Pod{testPod("api-1", 0), testPod("api-3", 1)},
+			lastPod: "api-2",
+			want:    "api-3",
+		},
+	}
+	for _, test := range tests {
+		tunnel := testTunnel(test.tunnel)
+		pod, skipped, err := PickPod(listTestPods(t, tunnel, test.pods...), tunnel, test.lastPod)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		got := ""
+		if pod != nil {
+			got = pod.Name
+		}
+		if got != test.want {
+			t.Errorf("%s: got pod %q, want %q", test.name, got, test.want)
+		}
+		if len(skipped) != len(test.skipped) {
+			t.Errorf("%s: got skipped %q, want %q", test.name, skipped, test.skipped)
+			continue
+		}
+		for i := range skipped {
+			if skipped[i] != test.skipped[i] {
+				t.Errorf("%s: got skipped %q, want %q", test.name, skipped, test.skipped)
+				break
+			}
+		}
+	}
+}
+
+func TestFindPod(t *testing.T) {
+	tests := []struct {
+		name    string
+		tunnel  Tunnel
+		tiers   [][]string
+		pods    []*v1.Pod
+		lastPod string
+		want    string
+		tier    int
+		err     string
+	}{
+		{
+			name: "selector",
+			pods: []*v1.Pod{testPod("web-1", 0, otherApp), testPod("api-2", 1)},
+			want: "api-2",
+		},
+		{
+			name:   "field selector",
+			tunnel: Tunnel{FieldSelector: "spec.nodeName=node-b"},
+			pods:   []*v1.Pod{testPod("api-1", 0, onNode("node-a")), testPod("api-2", 1, onNode("node-b"))},
+			want:   "api-2",
+		},
+		{
+			name:   "pod",
+			tunnel: Tunnel{Pod: "api-2"},
+			pods:   []*v1.Pod{testPod("api-1", 0), testPod("api-2", 1)},
+			want:   "api-2",
+		},
+		{
+			name:   "pod is gone",
+			tunnel: Tunnel{Pod: "api-3"},
+			pods:   []*v1.Pod{testPod("api-1", 0)},
+			err:    errNoPods.Error(),
+		},
+		{
+			name: "no pods",
+			pods: []*v1.Pod{testPod("web-1", 0, otherApp)},
+			err:  errNoPods.Error(),
+		},
+		{
+			name: "not ready without wait_for_ready",
+			pods: []*v1.Pod{testPod("api-1", 0, terminating)},
+			err:  "All pods for app=api are terminating",
+		},
+		{
+			name:   "failover",
+			tunnel: Tunnel{Failover: StringList{"app=web"}},
+			tiers:  [][]string{{"app=api"}, {"app=web"}},
+			pods:   []*v1.Pod{testPod("api-1", 0, notReady), testPod("web-1", 1, otherApp)},
+			want:   "web-1",
+			tier:   1,
+		},
+		{
+			name:   "failover prefers the first tier",
+			tunnel: Tunnel{Failover: StringList{"app=web"}},
+			tiers:  [][]string{{"app=api"}, {"app=web"}},
+			pods:   []*v1.Pod{testPod("web-1", 0, otherApp), testPod("api-2", 1)},
+			want:   "api-2",
+		},
+		{
+			name:    "sticky",
+			tunnel:  Tunnel{Sticky: true},
+			pods:    []*v1.Pod{testPod("api-1", 0), testPod("api-2", 1)},
+			lastPod: "api-2",
+			want:    "api-2",
+		},
+		{
+			name:    "sticky pod is gone",
+			tunnel:  Tunnel{Sticky: true},
+			pods:    []*v1.Pod{testPod("api-1", 0), testPod("api-3", 1)},
+			lastPod: "api-2",
+			want:    "api-1",
+		},
+		{
+			name:   "wait_for_ready",
+			tunnel: Tunnel{WaitForReady: true},
+			pods:   []*v1.Pod{testPod("api-1", 0, notReady), testPod("api-2", 1)},
+			want:   "api-2",
+		},
+		{
+			name:   "wait_for_ready gives up after ready_timeout",
+			tunnel: Tunnel{WaitForReady: true, ReadyTimeout: Duration{time.Nanosecond}},
+			pods:   []*v1.Pod{testPod("api-1", 0, notReady), testPod("api-2", 1, pending)},
+			err:    "No ready pods found for app=api after 1ns: api-1 (container c is not ready), api-2 (phase is Pending)",
+		},
+		{
+			name:   "wait_for_pod gives up after ready_timeout",
+			tunnel: Tunnel{WaitForPod: true, ReadyTimeout: Duration{20 * time.Millisecond}},
+			err:    "No pods found for app=api after 20ms",
+		},
+	}
+	for _, test := range tests {
+		tunnel := testTunnel(test.tunnel)
+		tiers := test.tiers
+		if tiers == nil {
+			tiers = [][]string{tunnel.Selector}
+		}
+		pod, tier, err := findPod(gocontext.Background(), testClientSet(test.pods...), Log{}, tunnel, tiers, test.lastPod)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if pod.Name != test.want || tier != test.tier {
+			t.Errorf("%s: got pod %s in tier %d, want %s in tier %d", test.name, pod.Name, tier, test.want, test.tier)
+		}
+	}
+}
+
+// TestFindPodWaitForPod checks that a tunnel with wait_for_pod picks up a pod
+// that is created while it waits.
+func TestFindPodWaitForPod(t *testing.T) {
+	clientSet := testClientSet()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		clientSet.CoreV1().Pods("team").Create(testPod("api-1", 0))
+	}()
+	tunnel := testTunnel(Tunnel{WaitForPod: true})
+	pod, _, err := findPod(gocontext.Background(), clientSet, Log{}, tunnel, [][]string{tunnel.Selector}, "")
+	if err != nil {
+		t.Fatalf("findPod: %s", err.Error())
+	}
+	if pod.Name != "api-1" {
+		t.Errorf("got pod %s, want api-1", pod.Name)
+	}
+}
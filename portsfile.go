@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ForwardedPort is an entry in the -ports-file, for scripts that need to
+// know where the tunnels ended up, e.g. with local_port = "auto". There is
+// one for every local address of every port.
+type ForwardedPort struct {
+	Context     string      `json:"context"`
+	Selector    string      `json:"selector"`
+	BindAddress string      `json:"bind_address"`
+	LocalPort   int         `json:"local_port"`
+	Pod         string      `json:"pod"`
+	PodPort     interface{} `json:"pod_port,omitempty"`
+}
+
+// ForwardedPorts returns the ports of every tunnel, and false if some of
+// them aren't ready.
+func (this *Proxy) ForwardedPorts() ([]ForwardedPort, bool) {
+	states := this.States()
+	this.mutex.Lock()
+	tunnels := make(map[string]Tunnel, len(states))
+	for _, state := range states {
+		if entry, ok := this.entries[state.Key]; ok {
+			tunnels[state.Key] = entry.tunnel
+		}
+	}
+	this.mutex.Unlock()
+
+	ports := []ForwardedPort{}
+	for _, state := range states {
+		if state.State != StateUp {
+			return nil, false
+		}
+		tunnel := tunnels[state.Key]
+		// LocalPorts has the ports that were picked for auto, in the same
+		// order as the mappings. With fanout, there is one pod per port.
+		locals := strings.Split(state.LocalPorts, ",")
+		if tunnel.Mode == ModeFanout {
+			for i, pod := range strings.Split(state.Pod, ",") {
+				port, _ := strconv.Atoi(locals[i])
+				for _, address := range tunnel.BindAddresses(PortMapping{}) {
+					ports = append(ports, ForwardedPort{
+						Context:     state.Context,
+						Selector:    state.Namespace + "/" + state.Target,
+						BindAddress: address,
+						LocalPort:   port,
+						Pod:         pod,
+						PodPort:     tunnel.PodPort.Number,
+					})
+				}
+			}
+			continue
+		}
+		for i, mapping := range tunnel.PortMappings() {
+			local := mapping.Local
+			if i < len(locals) {
+				if n, err := strconv.Atoi(locals[i]); err == nil {
+					local = n
+				}
+			}
+			var podPort interface{}
+			if !tunnel.Socks {
+				podPort = mapping.Pod.Number
+				if mapping.Pod.Name != "" {
+					podPort = mapping.Pod.Name
+				}
+			}
+			for _, address := range tunnel.BindAddresses(mapping) {
+				ports = append(ports, ForwardedPort{
+					Context:     state.Context,
+					Selector:    state.Namespace + "/" + state.Target,
+					BindAddress: address,
+					LocalPort:   local,
+					Pod:         state.Pod,
+					PodPort:     podPort,
+				})
+			}
+		}
+	}
+	return ports, true
+}
+
+// watchPortsFile writes the ports of the tunnels to path as JSON once all of
+// them are ready, and again whenever a tunnel comes back on another pod. It
+// must be started before the tunnels, so that no changes are missed.
+func watchPortsFile(proxy *Proxy, path string) {
+	events, _ := proxy.Subscribe()
+	go func() {
+		var last []byte
+		for range events {
+			ports, ready := proxy.ForwardedPorts()
+			if !ready {
+				continue
+			}
+			data, err := json.MarshalIndent(ports, "", "  ")
+			if err != nil {
+				Log{}.Errorf("Could not encode the ports: %s", err.Error())
+				continue
+			}
+			data = append(data, '\n')
+			if bytes.Equal(data, last) {
+				continue
+			}
+			if err := writeFileAtomic(path, data); err != nil {
+				Log{}.Errorf("Could not write the ports to %s: %s", path, err.Error())
+				continue
+			}
+			Log{}.Debugf("Wrote %d ports to %s.", len(ports), path)
+			last = data
+		}
+	}()
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it,
+// so that readers never see a partly written file.
+func writeFileAtomic(path string, data []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
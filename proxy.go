@@ -0,0 +1,507 @@
+package main
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Proxy keeps track of the running tunnels, so that they can be started and
+// stopped individually when the config is reloaded.
+type Proxy struct {
+	ctx   gocontext.Context
+	mutex sync.Mutex
+	// running counts the running tunnels and the Apply calls in progress,
+	// and idle is closed whenever it drops to zero. A WaitGroup can't be
+	// used, since reloads start tunnels while Wait is waiting.
+	running    int
+	idle       chan struct{}
+	tunnels    map[string]*runningTunnel
+	numStarted int32
+	numStopped int32
+	// The tunnels that stopped with an error before ever becoming ready.
+	neverStarted []string
+	// The tunnels that stopped with an error, until they are started again.
+	failed map[string]bool
+	// How many times each tunnel has become ready, across restarts.
+	connects map[string]int
+	// OnFailure is called when a tunnel with exit_on_failure stops with an
+	// error.
+	OnFailure func(key string)
+	// The tunnels in the current config, in order.
+	keys    []string
+	entries map[string]*tunnelEntry
+	// The subscribers to the tunnels' events, and the last event sent for
+	// each tunnel.
+	eventMutex  sync.Mutex
+	subscribers map[chan TunnelEvent]bool
+	lastEvents  map[string]TunnelEvent
+}
+
+// tunnelEntry is a tunnel in the current config, and how to start it. run is
+// nil when the tunnel's context could not be set up.
+type tunnelEntry struct {
+	context string
+	tunnel  Tunnel
+	run     func(ctx gocontext.Context, setUp func(up bool, pod string, ports string)) error
+}
+
+type runningTunnel struct {
+	cancel    gocontext.CancelFunc
+	done      chan struct{}
+	ready     chan struct{}
+	readyOnce sync.Once
+	up        int32
+	pod       atomic.Value
+	// The local ports, including the ones picked with auto.
+	ports atomic.Value
+	// When the tunnel last became ready.
+	upSince int64
+}
+
+// Diff describes what Apply changed.
+type Diff struct {
+	Added         []string
+	Removed       []string
+	Kept          []string
+	Failed        []string
+	ContextErrors map[string]error
+}
+
+func NewProxy(ctx gocontext.Context) *Proxy {
+	idle := make(chan struct{})
+	close(idle)
+	return &Proxy{
+		ctx:         ctx,
+		idle:        idle,
+		tunnels:     make(map[string]*runningTunnel),
+		entries:     make(map[string]*tunnelEntry),
+		failed:      make(map[string]bool),
+		connects:    make(map[string]int),
+		subscribers: make(map[chan TunnelEvent]bool),
+		lastEvents:  make(map[string]TunnelEvent),
+	}
+}
+
+// TunnelKey identifies a tunnel across config reloads. Tunnels with the same
+// context, namespace, target and ports are considered unchanged.
+func TunnelKey(context string, tunnel Tunnel) string {
+	var ports []string
+	for _, mapping := range tunnel.PortMappings() {
+		ports = append(ports, mapping.String())
+	}
+	return fmt.Sprintf("%s/%s/%s %s", context, tunnel.Namespace, tunnel.Target(), strings.Join(ports, ","))
+}
+
+// Apply stops the running tunnels that are no longer in the config, and
+// starts the ones that aren't running yet.
+func (this *Proxy) Apply(config Config) Diff {
+	diff := Diff{
+		ContextErrors: make(map[string]error),
+	}
+	// Wait must not return between stopping the removed tunnels and
+	// starting the added ones, e.g. when a reload replaces all of them.
+	this.addRunning()
+	defer this.doneRunning()
+
+	wanted := make(map[string]bool)
+	keys := make([][]string, len(config.Contexts))
+	for i, context := range config.Contexts {
+		keys[i] = make([]string, len(context.Tunnels))
+		for j, tunnel := range context.Tunnels {
+			key := TunnelKey(context.Name, tunnel)
+			for n := 2; wanted[key]; n++ {
+				key = fmt.Sprintf("%s #%d", TunnelKey(context.Name, tunnel), n)
+			}
+			wanted[key] = true
+			keys[i][j] = key
+		}
+	}
+
+	// Stop the removed tunnels first, so that their local ports are free
+	// for the added ones.
+	var stopped []*runningTunnel
+	this.mutex.Lock()
+	this.keys = nil
+	entries := make(map[string]*tunnelEntry)
+	for i, context := range config.Contexts {
+		this.keys = append(this.keys, keys[i]...)
+		for j, tunnel := range context.Tunnels {
+			entries[keys[i][j]] = &tunnelEntry{context: context.Name, tunnel: tunnel}
+			if old, ok := this.entries[keys[i][j]]; ok {
+				entries[keys[i][j]].run = old.run
+			}
+		}
+	}
+	this.entries = entries
+	for key, t := range this.tunnels {
+		if !wanted[key] {
+			diff.Removed = append(diff.Removed, key)
+			stopped = append(stopped, t)
+			t.cancel()
+		}
+	}
+	this.mutex.Unlock()
+	for _, t := range stopped {
+		<-t.done
+	}
+
+	for i, context := range config.Contexts {
+		var added []int
+		this.mutex.Lock()
+		for j := range context.Tunnels {
+			if _, ok := this.tunnels[keys[i][j]]; ok {
+				diff.Kept = append(diff.Kept, keys[i][j])
+			} else {
+				added = append(added, j)
+			}
+		}
+		this.mutex.Unlock()
+		if len(added) == 0 {
+			continue
+		}
+
+		log := Log{Context: context.Name}
+		if context.Kubeconfig != "" {
+			log.Infof("Setting up %d tunnels using %s.", len(added), context.Kubeconfig)
+		} else {
+			log.Infof("Setting up %d tunnels.", len(added))
+		}
+		cfg, clientSet, err := NewClient(context)
+		if err != nil {
+			log.Errorf("%s. Skipping %d tunnels.", err.Error(), len(added))
+			diff.ContextErrors[context.Name] = err
+			this.mutex.Lock()
+			for _, j := range added {
+				diff.Failed = append(diff.Failed, keys[i][j])
+				this.neverStarted = append(this.neverStarted, fmt.Sprintf("%s: %s", keys[i][j], err.Error()))
+			}
+			this.mutex.Unlock()
+			continue
+		}
+		runs := make([]func(ctx gocontext.Context, setUp func(up bool, pod string, ports string)) error, len(context.Tunnels))
+		this.mutex.Lock()
+		for j := range context.Tunnels {
+			tunnel := context.Tunnels[j]
+			runs[j] = func(ctx gocontext.Context, setUp func(up bool, pod string, ports string)) error {
+				if tunnel.Mode == ModeFanout {
+					return Fanout(ctx, cfg, clientSet, context.Name, context.Protocol, context.ProxyURL, tunnel, setUp)
+				}
+				return PortForward(ctx, cfg, clientSet, context.Name, context.Protocol, context.ProxyURL, tunnel, setUp)
+			}
+			this.entries[keys[i][j]].run = runs[j]
+		}
+		this.mutex.Unlock()
+		for _, j := range added {
+			diff.Added = append(diff.Added, keys[i][j])
+			this.start(keys[i][j], runs[j])
+		}
+	}
+	return diff
+}
+
+// start runs the tunnel in the background, unless it is already running.
+func (this *Proxy) start(key string, run func(ctx gocontext.Context, setUp func(up bool, pod string, ports string)) error) bool {
+	ctx, cancel := gocontext.WithCancel(this.ctx)
+	t := &runningTunnel{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		ready:  make(chan struct{}),
+	}
+	this.mutex.Lock()
+	if _, ok := this.tunnels[key]; ok {
+		this.mutex.Unlock()
+		cancel()
+		return false
+	}
+	this.tunnels[key] = t
+	delete(this.failed, key)
+	this.mutex.Unlock()
+	this.changed(key)
+
+	this.addRunning()
+	atomic.AddInt32(&this.numStarted, 1)
+	go func() {
+		defer this.doneRunning()
+		defer close(t.done)
+		defer cancel()
+		setUp := func(up bool, pod string, ports string) {
+			t.pod.Store(pod)
+			if up {
+				t.ports.Store(ports)
+				atomic.StoreInt64(&t.upSince, time.Now().UnixNano())
+				this.mutex.Lock()
+				this.connects[key]++
+				this.mutex.Unlock()
+				atomic.StoreInt32(&t.up, 1)
+				t.readyOnce.Do(func() { close(t.ready) })
+			} else {
+				atomic.StoreInt32(&t.up, 0)
+			}
+			this.changed(key)
+		}
+		err := run(ctx, setUp)
+		if err == nil {
+			atomic.AddInt32(&this.numStopped, 1)
+		}
+		this.mutex.Lock()
+		select {
+		case <-t.ready:
+		default:
+			if err != nil {
+				this.neverStarted = append(this.neverStarted, fmt.Sprintf("%s: %s", key, err.Error()))
+			}
+		}
+		if this.tunnels[key] == t {
+			delete(this.tunnels, key)
+		}
+		var exit bool
+		if err != nil && this.ctx.Err() == nil {
+			this.failed[key] = true
+			if entry, ok := this.entries[key]; ok {
+				exit = entry.tunnel.ExitOnFailure
+			}
+		}
+		this.mutex.Unlock()
+		this.changed(key)
+		if exit && this.OnFailure != nil {
+			this.OnFailure(key)
+		}
+	}()
+	return true
+}
+
+func (this *Proxy) addRunning() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.running == 0 {
+		this.idle = make(chan struct{})
+	}
+	this.running++
+}
+
+func (this *Proxy) doneRunning() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.running--
+	if this.running == 0 {
+		close(this.idle)
+	}
+}
+
+// WaitReady waits for the given tunnels to become ready for the first time,
+// and returns the ones that didn't. A timeout of zero waits indefinitely.
+func (this *Proxy) WaitReady(keys []string, timeout time.Duration) []string {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	var notReady []string
+	for _, key := range keys {
+		this.mutex.Lock()
+		t, ok := this.tunnels[key]
+		this.mutex.Unlock()
+		if !ok {
+			notReady = append(notReady, key)
+			continue
+		}
+		select {
+		case <-t.ready:
+		case <-t.done:
+			notReady = append(notReady, key)
+		case <-deadline:
+			notReady = append(notReady, key)
+		}
+	}
+	return notReady
+}
+
+// NeverStarted returns the tunnels that failed before they became ready,
+// along with the error.
+func (this *Proxy) NeverStarted() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return append([]string(nil), this.neverStarted...)
+}
+
+const (
+	StateUp      = "up"
+	StateDown    = "down"
+	StateStopped = "stopped"
+	StateFailed  = "failed"
+)
+
+// TunnelState is the state of a tunnel in the current config. ID is the
+// tunnel's position in the config, starting at 1.
+type TunnelState struct {
+	ID   int    `json:"id"`
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	// Description is the tunnel's description from the config, if any.
+	Description string `json:"description,omitempty"`
+	Context     string `json:"context"`
+	Namespace   string `json:"namespace"`
+	Target      string `json:"selector"`
+	LocalPorts  string `json:"local_port"`
+	Pod         string `json:"pod,omitempty"`
+	State       string `json:"state"`
+	// Connects counts how many times the tunnel has become ready.
+	Connects int        `json:"connects"`
+	UpSince  *time.Time `json:"up_since,omitempty"`
+}
+
+// States returns the state of every tunnel in the current config. Tunnels
+// that are no longer running, e.g. because their context failed or they were
+// stopped through the control socket, are stopped, or failed if they stopped
+// with an error.
+func (this *Proxy) States() []TunnelState {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	states := make([]TunnelState, len(this.keys))
+	for i, key := range this.keys {
+		entry := this.entries[key]
+		states[i] = TunnelState{
+			ID:          i + 1,
+			Key:         key,
+			Name:        entry.tunnel.DisplayName(entry.context),
+			Description: entry.tunnel.Description,
+			Context:     entry.context,
+			Namespace:   entry.tunnel.Namespace,
+			Target:      entry.tunnel.Target(),
+			LocalPorts:  localPorts(entry.tunnel),
+			State:       StateStopped,
+			Connects:    this.connects[key],
+		}
+		if this.failed[key] {
+			states[i].State = StateFailed
+		}
+		if t, ok := this.tunnels[key]; ok {
+			states[i].State = StateDown
+			if atomic.LoadInt32(&t.up) == 1 {
+				states[i].State = StateUp
+				upSince := time.Unix(0, atomic.LoadInt64(&t.upSince))
+				states[i].UpSince = &upSince
+			}
+			states[i].Pod, _ = t.pod.Load().(string)
+			if ports, ok := t.ports.Load().(string); ok {
+				states[i].LocalPorts = ports
+			}
+		}
+	}
+	return states
+}
+
+// lookup returns the key of the tunnel with the given ID, name or key.
+func (this *Proxy) lookup(id string) (string, error) {
+	if n, err := strconv.Atoi(id); err == nil {
+		if n < 1 || n > len(this.keys) {
+			return "", fmt.Errorf("There is no tunnel %d", n)
+		}
+		return this.keys[n-1], nil
+	}
+	for _, key := range this.keys {
+		entry := this.entries[key]
+		if entry.tunnel.DisplayName(entry.context) == id {
+			return key, nil
+		}
+	}
+	if _, ok := this.entries[id]; !ok {
+		return "", fmt.Errorf("There is no tunnel %s", id)
+	}
+	return id, nil
+}
+
+// Stop stops a running tunnel, given its ID or key, and waits for it. It
+// stays stopped until it is started again or the config is reloaded.
+func (this *Proxy) Stop(id string) error {
+	this.mutex.Lock()
+	key, err := this.lookup(id)
+	if err != nil {
+		this.mutex.Unlock()
+		return err
+	}
+	t, ok := this.tunnels[key]
+	entry := this.entries[key]
+	this.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("%s is not running", key)
+	}
+	Log{Context: entry.context, Tunnel: entry.tunnel.Target()}.Infof("Stopping %s.", key)
+	t.cancel()
+	<-t.done
+	return nil
+}
+
+// Start starts a stopped tunnel, given its ID or key.
+func (this *Proxy) Start(id string) error {
+	if this.ctx.Err() != nil {
+		return errors.New("Shutting down")
+	}
+	this.mutex.Lock()
+	key, err := this.lookup(id)
+	if err != nil {
+		this.mutex.Unlock()
+		return err
+	}
+	entry := this.entries[key]
+	this.mutex.Unlock()
+	if entry.run == nil {
+		return fmt.Errorf("%s can't be started since its context could not be set up", key)
+	}
+	if !this.start(key, entry.run) {
+		return fmt.Errorf("%s is already running", key)
+	}
+	Log{Context: entry.context, Tunnel: entry.tunnel.Target()}.Infof("Started %s.", key)
+	return nil
+}
+
+// Restart stops a tunnel, given its ID or key, if it is running, and starts
+// it again with the same config. It waits up to timeout for the tunnel to
+// become ready, and returns its new state.
+func (this *Proxy) Restart(id string, timeout time.Duration) (TunnelState, error) {
+	this.mutex.Lock()
+	key, err := this.lookup(id)
+	this.mutex.Unlock()
+	if err != nil {
+		return TunnelState{}, err
+	}
+	// The only error is that the tunnel isn't running, which is fine.
+	this.Stop(key)
+	if err := this.Start(key); err != nil {
+		return TunnelState{}, err
+	}
+	notReady := this.WaitReady([]string{key}, timeout)
+	state := this.state(key)
+	if len(notReady) > 0 {
+		return state, fmt.Errorf("%s did not become ready within %s", key, timeout)
+	}
+	return state, nil
+}
+
+// state returns the state of the tunnel with the given key.
+func (this *Proxy) state(key string) TunnelState {
+	for _, state := range this.States() {
+		if state.Key == key {
+			return state
+		}
+	}
+	return TunnelState{Key: key, State: StateStopped}
+}
+
+// Wait blocks until all tunnels have stopped, and returns how many tunnels
+// were started and how many of them were stopped cleanly.
+func (this *Proxy) Wait() (started int32, stopped int32) {
+	this.mutex.Lock()
+	idle := this.idle
+	this.mutex.Unlock()
+	<-idle
+	return atomic.LoadInt32(&this.numStarted), atomic.LoadInt32(&this.numStopped)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	gocontext "context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// dialFunc connects to the pod for a local connection.
+type dialFunc func(conn net.Conn) (io.ReadWriteCloser, error)
+
+// relay accepts connections on a tunnel's local port and relays them to the
+// pod, using dial to connect either to client-go's listener on an internal
+// port or over a WebSocket. client-go doesn't let us see the forwarded
+// connections, so this is where the traffic is counted. A relay can outlive
+// the session it was created for: while there is no session, connections wait
+// for the next one and wake is signalled.
+type relay struct {
+	listeners  []net.Listener
+	log        Log
+	stats      *TunnelMetrics
+	wake       chan<- struct{}
+	wg         sync.WaitGroup
+	mutex      sync.Mutex
+	dial       dialFunc
+	dialReady  chan struct{}
+	conns      map[io.Closer]struct{}
+	active     int
+	lastActive time.Time
+	closed     bool
+	done       chan struct{}
+	// limiter caps the open connections of the whole tunnel, if it is set.
+	limiter *connLimiter
+	// ioTimeout closes connections that have been without traffic in either
+	// direction for this long, if it is set.
+	ioTimeout time.Duration
+	// With once, no more connections are accepted after the first one, and
+	// how it went is sent to finished once it is closed.
+	finished chan<- error
+}
+
+// listenRelay listens on the mapping's local port on all of its addresses,
+// with TLS if tlsConfig is set, and starts accepting connections. They are
+// relayed once setDial is called. The connections use the tunnel's
+// tcp_keepalive and io_timeout, and count towards limiter. finished is only
+// used with once.
+func listenRelay(tunnel Tunnel, mapping PortMapping, tlsConfig *tls.Config, log Log, stats *TunnelMetrics, limiter *connLimiter, wake chan<- struct{}, finished chan<- error) (*relay, error) {
+	this := &relay{
+		log:        log,
+		stats:      stats,
+		limiter:    limiter,
+		wake:       wake,
+		dialReady:  make(chan struct{}),
+		conns:      make(map[io.Closer]struct{}),
+		lastActive: time.Now(),
+		done:       make(chan struct{}),
+		ioTimeout:  tunnel.IOTimeout.Duration,
+	}
+	if tunnel.Once {
+		this.finished = finished
+	}
+	localPort := mapping.Local
+	listenConfig := net.ListenConfig{KeepAlive: tunnel.TCPKeepalive.Duration}
+	for _, address := range tunnel.BindAddresses(mapping) {
+		listener, err := listenConfig.Listen(gocontext.Background(), "tcp", net.JoinHostPort(address, strconv.Itoa(localPort)))
+		if err != nil {
+			this.Close()
+			return nil, fmt.Errorf("Could not listen on %s:%d: %s", address, localPort, err.Error())
+		}
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+		this.listeners = append(this.listeners, listener)
+	}
+	for _, listener := range this.listeners {
+		this.wg.Add(1)
+		go this.accept(listener)
+	}
+	return this, nil
+}
+
+// addresses returns the addresses that the relay is listening on.
+func (this *relay) addresses() []string {
+	addresses := make([]string, len(this.listeners))
+	for i, listener := range this.listeners {
+		addresses[i] = listener.Addr().String()
+	}
+	return addresses
+}
+
+// setDial sets how to connect to the pod for the current session, or nil
+// when the session has ended.
+func (this *relay) setDial(dial dialFunc) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if dial != nil && this.dial == nil {
+		close(this.dialReady)
+		this.lastActive = time.Now()
+	} else if dial == nil && this.dial != nil {
+		this.dialReady = make(chan struct{})
+	}
+	this.dial = dial
+}
+
+// waitDial returns the dial for the current session, waiting for one if
+// needed. It returns nil if the relay is closed first.
+func (this *relay) waitDial() dialFunc {
+	for {
+		this.mutex.Lock()
+		dial, dialReady := this.dial, this.dialReady
+		this.mutex.Unlock()
+		if dial != nil {
+			return dial
+		}
+		select {
+		case this.wake <- struct{}{}:
+		default:
+		}
+		select {
+		case <-dialReady:
+		case <-this.done:
+			return nil
+		}
+	}
+}
+
+// stopAccepting stops listening, so that new connections are refused while
+// the open ones carry on.
+func (this *relay) stopAccepting() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for _, listener := range this.listeners {
+		listener.Close()
+	}
+}
+
+// numActive returns how many connections are open.
+func (this *relay) numActive() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.active
+}
+
+// drainRelays stops accepting connections on the relays and waits up to
+// timeout for the open ones to finish. The ones that are left are closed
+// with the relays.
+func drainRelays(log Log, relays []*relay, timeout time.Duration) {
+	open := func() int {
+		n := 0
+		for _, relay := range relays {
+			n += relay.numActive()
+		}
+		return n
+	}
+	for _, relay := range relays {
+		relay.stopAccepting()
+	}
+	before := open()
+	if before == 0 {
+		return
+	}
+	log.Infof("Waiting up to %s for %d connections to finish.", timeout, before)
+	deadline := time.Now().Add(timeout)
+	for open() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	left := open()
+	if left > 0 {
+		log.Warnf("Drained %d connections, closing %d that were still open after drain_timeout %s.", before-left, left, timeout)
+	} else {
+		log.Infof("Drained %d connections.", before)
+	}
+}
+
+// drainPollInterval is how often drainRelays checks for open connections.
+const drainPollInterval = 100 * time.Millisecond
+
+// idleFor returns how long the relay has been without connections, counting
+// from the start of the session at the earliest.
+func (this *relay) idleFor() time.Duration {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.active > 0 {
+		return 0
+	}
+	return time.Since(this.lastActive)
+}
+
+func (this *relay) accept(listener net.Listener) {
+	defer this.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if !this.track(conn) {
+			conn.Close()
+			return
+		}
+		this.wg.Add(1)
+		go this.handle(conn)
+		if this.finished != nil {
+			for _, listener := range this.listeners {
+				listener.Close()
+			}
+			return
+		}
+	}
+}
+
+func (this *relay) handle(conn net.Conn) {
+	defer this.wg.Done()
+	var result error
+	if this.finished != nil {
+		defer func() {
+			select {
+			case this.finished <- result:
+			default:
+			}
+		}()
+	}
+	defer this.untrack(conn)
+	defer conn.Close()
+
+	this.mutex.Lock()
+	this.active++
+	this.mutex.Unlock()
+	defer func() {
+		this.mutex.Lock()
+		this.active--
+		this.lastActive = time.Now()
+		this.mutex.Unlock()
+	}()
+
+	if !this.limiter.acquire(this.log, conn.RemoteAddr(), this.done) {
+		result = errors.New("The connection was over max_connections")
+		return
+	}
+	defer this.limiter.release()
+
+	dial := this.waitDial()
+	if dial == nil {
+		result = errors.New("The tunnel stopped before the connection was forwarded")
+		return
+	}
+	upstream, err := dial(conn)
+	if err != nil {
+		this.log.Errorf("Could not connect to the tunnel: %s", err.Error())
+		result = err
+		return
+	}
+	if !this.track(upstream) {
+		upstream.Close()
+		return
+	}
+	defer this.untrack(upstream)
+	defer upstream.Close()
+	this.stats.AddConnection()
+
+	// Both reads count as traffic, so only connections that are quiet in
+	// both directions time out.
+	var from io.Reader = conn
+	var to io.Reader = upstream
+	if this.ioTimeout > 0 {
+		timer := time.AfterFunc(this.ioTimeout, func() {
+			this.log.Infof("Closing a connection from %s after io_timeout %s without traffic.", conn.RemoteAddr(), this.ioTimeout)
+			conn.Close()
+			upstream.Close()
+		})
+		defer timer.Stop()
+		from = &activityReader{conn, timer, this.ioTimeout}
+		to = &activityReader{upstream, timer, this.ioTimeout}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, _ := io.Copy(upstream, from)
+		this.stats.AddBytes(n, 0)
+		if upstream, ok := upstream.(interface{ CloseWrite() error }); ok {
+			upstream.CloseWrite()
+		}
+	}()
+	n, _ := io.Copy(conn, to)
+	this.stats.AddBytes(0, n)
+	if conn, ok := conn.(interface{ CloseWrite() error }); ok {
+		conn.CloseWrite()
+	}
+	<-done
+}
+
+// activityReader resets timer to timeout whenever something is read.
+type activityReader struct {
+	reader  io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (this *activityReader) Read(p []byte) (int, error) {
+	n, err := this.reader.Read(p)
+	if n > 0 {
+		this.timer.Reset(this.timeout)
+	}
+	return n, err
+}
+
+func (this *relay) track(conn io.Closer) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.closed {
+		return false
+	}
+	this.conns[conn] = struct{}{}
+	return true
+}
+
+func (this *relay) untrack(conn io.Closer) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	delete(this.conns, conn)
+}
+
+// Close stops listening, closes the open connections and waits for them to
+// finish.
+func (this *relay) Close() {
+	this.mutex.Lock()
+	if !this.closed {
+		close(this.done)
+	}
+	this.closed = true
+	for _, listener := range this.listeners {
+		listener.Close()
+	}
+	for conn := range this.conns {
+		conn.Close()
+	}
+	this.mutex.Unlock()
+	this.wg.Wait()
+}
+
+// connLimiter limits how many connections a tunnel has open at once, over
+// all of its local ports. A nil limiter doesn't limit anything.
+type connLimiter struct {
+	slots chan struct{}
+	queue bool
+	mutex sync.Mutex
+	full  bool
+}
+
+// newConnLimiter returns a limiter for the tunnel's max_connections, or nil if
+// it isn't set.
+func newConnLimiter(tunnel Tunnel) *connLimiter {
+	if tunnel.MaxConnections == 0 {
+		return nil
+	}
+	return &connLimiter{
+		slots: make(chan struct{}, tunnel.MaxConnections),
+		queue: tunnel.MaxConnectionsAction != LimitReject,
+	}
+}
+
+// acquire takes a slot for a connection from remote. When all are taken, it
+// either waits for one to be released or returns false right away, and also
+// returns false if done is closed first. Reaching the limit is logged once
+// until a slot is released.
+func (this *connLimiter) acquire(log Log, remote net.Addr, done <-chan struct{}) bool {
+	if this == nil {
+		return true
+	}
+	select {
+	case this.slots <- struct{}{}:
+		return true
+	default:
+	}
+	this.mutex.Lock()
+	if !this.full {
+		this.full = true
+		if this.queue {
+			log.Warnf("Reached max_connections %d, new connections wait for one to close.", cap(this.slots))
+		} else {
+			log.Warnf("Reached max_connections %d, new connections are rejected until one closes.", cap(this.slots))
+		}
+	}
+	this.mutex.Unlock()
+	if !this.queue {
+		log.Debugf("Rejected a connection from %s.", remote)
+		return false
+	}
+	select {
+	case this.slots <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (this *connLimiter) release() {
+	if this == nil {
+		return
+	}
+	<-this.slots
+	this.mutex.Lock()
+	this.full = false
+	this.mutex.Unlock()
+}
+
+// dialTCP connects to address, for relaying to client-go's listener.
+func dialTCP(address string) dialFunc {
+	return func(net.Conn) (io.ReadWriteCloser, error) {
+		return net.Dial("tcp", address)
+	}
+}
+
+// formatBytes formats n like 1.3MB.
+func formatBytes(n int64) string {
+	if n < 1000 {
+		return fmt.Sprintf("%dB", n)
+	}
+	value := float64(n)
+	for _, unit := range []string{"kB", "MB", "GB", "TB"} {
+		value /= 1000
+		if value < 1000 {
+			return fmt.Sprintf("%.1f%s", value, unit)
+		}
+	}
+	return fmt.Sprintf("%.1fPB", value/1000)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// logBanner logs what is about to run, once the config has been validated.
+func logBanner(config Config, configPath string) {
+	parts := []string{fmt.Sprintf("kube-tunnel-proxy %s: %d tunnels in %d contexts from %s", version, config.NumTunnels(), len(config.Contexts), configPath)}
+	if config.MetricsAddr != "" {
+		parts = append(parts, fmt.Sprintf("metrics on http://%s/metrics", config.MetricsAddr))
+	}
+	if config.HealthAddr != "" {
+		parts = append(parts, fmt.Sprintf("health checks on http://%s/healthz", config.HealthAddr))
+	}
+	if config.ControlSocket != "" {
+		parts = append(parts, fmt.Sprintf("control socket at %s", config.ControlSocket))
+	}
+	if config.OtelEndpoint != "" {
+		parts = append(parts, fmt.Sprintf("traces to %s", config.OtelEndpoint))
+	}
+	Log{}.Infof("%s.", strings.Join(parts, ", "))
+}
+
+// logReport logs how long the tunnels ran, how often each of them
+// reconnected, and which of them failed, when exiting.
+func logReport(uptime time.Duration, states []TunnelState) {
+	var lines []string
+	var failed int
+	for _, state := range states {
+		_, reconnects := describeState(state)
+		line := fmt.Sprintf("%s: %d reconnects", state.Name, reconnects)
+		if state.Connects == 0 {
+			line = fmt.Sprintf("%s: never ready", state.Name)
+		}
+		if state.State == StateFailed {
+			line += ", failed"
+			failed++
+		}
+		lines = append(lines, line)
+	}
+	msg := fmt.Sprintf("Ran for %s", uptime.Round(time.Second))
+	if failed > 0 {
+		msg += fmt.Sprintf(", %d of %d tunnels failed", failed, len(states))
+	}
+	if len(lines) > 0 {
+		msg += ":\n- " + strings.Join(lines, "\n- ")
+	} else {
+		msg += "."
+	}
+	Log{}.Eventf("%s", msg)
+}
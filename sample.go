@@ -0,0 +1,249 @@
+package main
+
+// sampleConfig is written by -init. Keep it in sync with the fields in
+// config.go.
+const sampleConfig = `# kube-tunnel-proxy config.
+# Every field is listed with its default value, unless noted otherwise.
+# $VAR, ${VAR} and ${VAR:-default} are replaced with environment variables,
+# except on comment lines. Use $$ for a literal $.
+
+# Log format, either "text" or "json".
+log_format = "text"
+
+# Log level, either "debug", "info", "warning" or "error". At warning level,
+# like with -quiet, tunnels becoming ready or stopping are still logged.
+log_level = "info"
+
+# Write the log to this file instead of stdout. It is rotated when it reaches
+# log_max_size_mb megabytes, keeping log_max_backups old files as
+# kube-tunnel-proxy.log.1 and so on. Not set by default.
+# log_file = "kube-tunnel-proxy.log"
+log_max_size_mb = 100
+log_max_backups = 3
+
+# Serve Prometheus metrics on this address, e.g. "127.0.0.1:9100".
+# Disabled by default.
+# metrics_addr = ""
+
+# Send traces of the tunnel sessions to this OpenTelemetry collector, with
+# OTLP over HTTP, e.g. "http://localhost:4318". Disabled by default.
+# otel_endpoint = ""
+
+# Serve /healthz, /readyz and /events on this address, e.g.
+# "127.0.0.1:8081". /readyz returns 200 once all tunnels are up, and /events
+# streams the tunnels' state changes. Disabled by default.
+# health_addr = ""
+
+# Serve a control socket at this path, to list, stop and start the tunnels
+# while running, e.g. with: echo list | nc -U /tmp/kube-tunnel-proxy.sock
+# Disabled by default.
+# control_socket = ""
+
+# How to talk to the pods: "spdy", "websocket", or "auto" to try WebSocket
+# and fall back to SPDY on clusters that don't support it. Can be overridden
+# per context.
+protocol = "spdy"
+
+# How many API requests, like looking up pods, each context can make per
+# second, and in a burst. Raise them for many tunnels on one cluster, or
+# lower them for a busy API server. Can be overridden per context.
+qps = 5
+burst = 10
+
+# Stop all tunnels and exit after this long, e.g. "2h" for a time-boxed
+# debugging session. A warning is logged a minute before. Can be overridden
+# with -stop-after. Disabled by default.
+# stop_after = "0s"
+
+# Default values for the settings that a tunnel leaves out, like namespace,
+# dial_timeout or reconnect_interval. A tunnel that sets one, even to false,
+# keeps its own value. What a tunnel forwards to, like its selector and
+# ports, isn't inherited.
+# [default]
+# namespace = "default"
+
+[[context]]
+# The name of the context in kubeconfig.
+name = "minikube"
+# Use a specific kubeconfig file for this context, instead of $KUBECONFIG or
+# ~/.kube/config.
+# kubeconfig = "/path/to/kubeconfig"
+# Use the service account of the pod that kube-tunnel-proxy runs in. The name
+# is optional for in-cluster contexts.
+# in_cluster = false
+# Connect to this API server with a bearer token, without kubeconfig, e.g. in
+# CI with a service account token. The name is optional and defaults to the
+# server's host. Can't be used with kubeconfig or in_cluster. Not set by
+# default.
+# server = "https://1.2.3.4:6443"
+# token = "${KUBE_TOKEN}"
+# Read the token from this file instead.
+# token_file = "/path/to/token"
+# Verify the server with this CA instead of the system's, or not at all.
+# ca_file = "/path/to/ca.crt"
+# insecure_skip_tls_verify = false
+# Impersonate a user, and optionally groups, like kubectl --as and
+# --as-group.
+# impersonate_user = "jane"
+# impersonate_groups = ["developers"]
+# Overrides the top-level protocol.
+# protocol = "spdy"
+# Connect to the cluster through this HTTP or HTTPS proxy, instead of the one
+# in $HTTPS_PROXY. Not set by default.
+# proxy_url = "http://proxy.example.com:3128"
+# Override the top-level qps and burst.
+# qps = 5
+# burst = 10
+# Default values for this context's tunnels, which take precedence over the
+# top-level [default].
+# [context.default]
+# dial_timeout = "5s"
+
+[[context.tunnel]]
+# A unique name for the tunnel, used in the logs, the SIGUSR1 table, the
+# control socket and the metrics. Defaults to an id like
+# "minikube/kube-system/k8s-app=kubernetes-dashboard:8000".
+# name = "dashboard"
+# A note about what the tunnel is for, shown in the SIGUSR1 table, the ready
+# log line, /readyz, /events and as a label of the metrics.
+# description = "Kubernetes dashboard"
+# Defaults to the context's namespace in kubeconfig, or "default" if it has
+# none. Set it to "*" to look for a ready pod in every namespace.
+namespace = "kube-system"
+# Forward to the first pod matching this label selector, or any of a list of
+# selectors, e.g. ["app=api", "app=api-canary"]...
+selector  = "k8s-app=kubernetes-dashboard"
+# Only consider the pods matching this field selector, e.g.
+# "spec.nodeName=node-1". Can be used with or instead of selector.
+# field_selector = ""
+# ...or to a ready pod backing this service. Use either selector or service.
+# service = ""
+# ...or to the pod with this name, like a StatefulSet replica, without a
+# selector.
+# pod = "db-0"
+# ...or to a ready pod of this deployment, statefulset, daemonset, replicaset
+# or replicationcontroller, using its selector.
+# resource = "deployment/my-app"
+# Fall back to the ready pods matching these selectors, in order, when none
+# of the pods above are ready, and switch back once they are. Not set by
+# default.
+# failover = ["app=db-replica"]
+# The port in the pod, either a number or the name of a container port. For
+# services, this is the service port. Only TCP can be forwarded, and
+# protocol = "udp" is an error.
+pod_port = 9090
+# The local port. Use "auto" to pick a free port. Defaults to pod_port, or to
+# "auto" when pod_port is a name. For a tunnel with a name, it can be
+# overridden with $KTP_<NAME>_LOCAL_PORT, e.g. $KTP_DASHBOARD_LOCAL_PORT.
+local_port = 8000
+# More ports to forward from the same pod, as "local:pod" pairs. The local
+# port can be "auto", and a single number is used for both. Start a pair with
+# an IP address to listen on it instead of bind_address, with IPv6 addresses
+# in brackets, e.g. "192.168.1.10:8002:80" or "[::1]:8002:80".
+# ports = ["8001:metrics", "auto:9000", "8080"]
+# The local addresses to listen on, either a string or a list.
+bind_address = "127.0.0.1"
+# How often the forwarded pod is checked for deletion. It used to be the delay
+# between reconnects, which is now min_backoff.
+reconnect_interval = "3s"
+# The delay between reconnects starts at min_backoff and doubles up to
+# max_backoff.
+min_backoff = "1s"
+max_backoff = "30s"
+# Only forward to pods that are running with all containers ready, and wait
+# up to ready_timeout for one.
+wait_for_ready = false
+ready_timeout  = "60s"
+# Keep looking for a pod every discovery_retry_interval when the selector
+# doesn't match any, instead of giving up. After ready_timeout, the tunnel
+# backs off and starts looking again.
+wait_for_pod = false
+discovery_retry_interval = "5s"
+# Timeout for every request to look up pods and services.
+discovery_timeout = "10s"
+# Wait a random time up to startup_jitter before first looking up pods, to
+# spread out the requests when many tunnels start at once.
+# startup_jitter = "2s"
+# Timeout for connecting to the pod. Tunnels that time out reconnect with
+# backoff.
+dial_timeout = "10s"
+# Close the port forward when there have been no connections for this long,
+# and reconnect on the next one. The local ports stay open. Not set by
+# default.
+# idle_timeout = "15m"
+# Reconnect, to a freshly picked pod, after the tunnel has been up for this
+# long. Useful when something between you and the cluster silently drops
+# long-lived connections. Not set by default.
+# max_lifetime = "1h"
+# How often to send TCP keepalives on the local connections, and on the
+# WebSocket and proxy connections to the API server, so that NATs and
+# firewalls don't drop them while they are idle.
+tcp_keepalive = "15s"
+# Close connections that have had no traffic in either direction for this
+# long, so that half-open connections don't pile up. Not set by default.
+# io_timeout = "1h"
+# How many local connections the tunnel can have open at once, over all of
+# its ports, e.g. to protect a fragile dev database. Zero means no limit.
+max_connections = 0
+# What to do with new connections over max_connections: "queue" them until
+# one closes, or "reject" them right away.
+max_connections_action = "queue"
+# When the tunnel stops, e.g. on shutdown, refuse new connections and wait up
+# to this long for the open ones to finish before closing them. Not set by
+# default.
+# drain_timeout = "30s"
+# Give up after this many reconnects in a row that don't become ready, and
+# mark the tunnel as failed. Zero means never give up.
+max_reconnects = 0
+# Stop all tunnels and exit with an error when this tunnel fails, instead of
+# keeping the others running.
+exit_on_failure = false
+# Stop the tunnel after its first connection is done, e.g. for a one-off
+# migration. -once does this for every tunnel.
+once = false
+# Either "first", "round-robin" or "fanout". round-robin moves to the next
+# ready pod on every reconnect. fanout forwards to every running pod at once,
+# each on its own local port counting up from local_port_base, instead of
+# local_port.
+mode = "first"
+# local_port_base = 27017
+# Pick the "newest" or "oldest" pod by creation time, instead of the first
+# one. Not set by default.
+# select = "newest"
+# Serve a SOCKS5 proxy on local_port instead, that connects through the pod
+# to any address it can reach. Every connection runs socat in the pod's
+# default container, so the image needs to have socat. pod_port and ports
+# can't be used with socks.
+socks = false
+# Reconnect to the same pod as before while it is ready, instead of picking
+# one again. Can't be used with round-robin.
+sticky = false
+# Fail to connect, instead of only warning, when no container in the pod
+# declares the pod port.
+strict_ports = false
+# Watch the pod to fail over as soon as it terminates, instead of polling
+# every reconnect_interval.
+watch = false
+# Commands to run with sh when the tunnel is up, and when it goes down again.
+# $KUBE_TUNNEL_CONTEXT, $KUBE_TUNNEL_NAMESPACE, $KUBE_TUNNEL_POD and
+# $KUBE_TUNNEL_LOCAL_PORT describe the tunnel, and need to be written with $$
+# so that they aren't replaced when the config is loaded. Not set by default.
+# on_ready = "open http://localhost:$$KUBE_TUNNEL_LOCAL_PORT"
+# on_stop = ""
+# Set to false to skip this tunnel.
+enabled = true
+# Start only the tunnels with a matching tag when using -tags.
+tags = ["dashboard"]
+# Serve TLS on the local ports with this certificate, or with a self-signed
+# certificate for localhost with tls = {}. The pod still gets plain text. Not
+# set by default.
+# tls = { cert_file = "cert.pem", key_file = "key.pem" }
+
+[[context.tunnel]]
+namespace  = "default"
+service    = "postgres"
+pod_port   = "postgres"
+local_port = 5432
+wait_for_ready = true
+tags       = ["db"]
+`
@@ -0,0 +1,48 @@
+package main
+
+import (
+	gocontext "context"
+	"sync"
+)
+
+// Semaphore limits how many tunnels talk to the API servers at the same
+// time, i.e. list pods or establish a port forward. A nil Semaphore doesn't
+// limit anything.
+type Semaphore struct {
+	slots chan struct{}
+}
+
+// connectSlots is set from -max-concurrency.
+var connectSlots *Semaphore
+
+func NewSemaphore(n int) *Semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return &Semaphore{
+		slots: make(chan struct{}, n),
+	}
+}
+
+// Acquire waits for a free slot, and returns the function that releases it,
+// which is safe to call more than once. It returns false if ctx is cancelled
+// first.
+func (this *Semaphore) Acquire(ctx gocontext.Context, log Log) (func(), bool) {
+	if this == nil {
+		return func() {}, true
+	}
+	select {
+	case this.slots <- struct{}{}:
+	default:
+		log.Infof("Waiting in line, %d tunnels are already connecting.", cap(this.slots))
+		select {
+		case this.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-this.slots })
+	}, true
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// SOCKS5, as described in RFC 1928. Only CONNECT without authentication is
+// supported.
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksNoMethods    = 0xff
+	socksConnect      = 1
+	socksIPv4         = 1
+	socksDomain       = 3
+	socksIPv6         = 4
+	socksSucceeded    = 0
+	socksFailure      = 1
+	socksNotSupported = 7
+	socksBadAddress   = 8
+)
+
+// socksDial returns a dialFunc that reads the SOCKS request from the local
+// connection, and connects to the requested address from inside the pod by
+// running socat there. The pod's default container needs to have socat.
+func socksDial(clientSet kubernetes.Interface, fwd *forwarder, log Log, tunnel Tunnel, podName string) dialFunc {
+	return func(conn net.Conn) (io.ReadWriteCloser, error) {
+		address, err := socksHandshake(conn)
+		if err != nil {
+			return nil, fmt.Errorf("SOCKS: %s", err.Error())
+		}
+		req := clientSet.CoreV1().RESTClient().Post().
+			Resource("pods").
+			Namespace(tunnel.Namespace).
+			Name(podName).
+			SubResource("exec").
+			VersionedParams(&v1.PodExecOptions{
+				Command: []string{"socat", "-", "TCP:" + address},
+				Stdin:   true,
+				Stdout:  true,
+				Stderr:  true,
+			}, scheme.ParameterCodec)
+		executor, err := remotecommand.NewSPDYExecutorForTransports(fwd.transport, fwd.upgrader, "POST", req.URL())
+		if err != nil {
+			socksReply(conn, socksFailure)
+			return nil, err
+		}
+		// socat doesn't say when it has connected, so the client is told that
+		// it succeeded right away. If it didn't, the connection is closed.
+		if err := socksReply(conn, socksSucceeded); err != nil {
+			return nil, err
+		}
+		return newExecConn(executor, log, address), nil
+	}
+}
+
+// socksHandshake negotiates the SOCKS5 connection and returns the address
+// that the client wants to connect to, as host:port.
+func socksHandshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(methods, socksNoAuth) == -1 {
+		conn.Write([]byte{socksVersion, socksNoMethods})
+		return "", errors.New("the client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != socksConnect {
+		socksReply(conn, socksNotSupported)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+	var host string
+	switch request[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksBadAddress)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// execConn is the stdin and stdout of a command running in a pod.
+type execConn struct {
+	stdin  *io.PipeWriter
+	stdout *io.PipeReader
+}
+
+func newExecConn(executor remotecommand.Executor, log Log, address string) *execConn {
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	go func() {
+		var stderr bytes.Buffer
+		err := executor.Stream(remotecommand.StreamOptions{
+			Stdin:  stdinReader,
+			Stdout: stdoutWriter,
+			Stderr: &stderr,
+		})
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			log.Warnf("socat %s: %s", address, msg)
+		} else if err != nil {
+			log.Warnf("socat %s: %s", address, err.Error())
+		}
+		stdinReader.Close()
+		stdoutWriter.Close()
+	}()
+	return &execConn{
+		stdin:  stdinWriter,
+		stdout: stdoutReader,
+	}
+}
+
+func (this *execConn) Read(b []byte) (int, error) {
+	return this.stdout.Read(b)
+}
+
+func (this *execConn) Write(b []byte) (int, error) {
+	return this.stdin.Write(b)
+}
+
+// CloseWrite closes stdin, so that socat closes its side of the connection.
+func (this *execConn) CloseWrite() error {
+	return this.stdin.Close()
+}
+
+func (this *execConn) Close() error {
+	this.stdin.Close()
+	return this.stdout.Close()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// PrintStatus writes a table with the state of every tunnel, for SIGUSR1.
+func PrintStatus(w io.Writer, states []TunnelState) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tCONTEXT\tSELECTOR\tPOD\tLOCAL PORT\tSTATE\tRECONNECTS\tUPTIME\tDESCRIPTION")
+	for _, state := range states {
+		status, reconnects := describeState(state)
+		uptime := "-"
+		if state.State == StateUp {
+			uptime = time.Since(*state.UpSince).Round(time.Second).String()
+		}
+		pod := state.Pod
+		if pod == "" {
+			pod = "-"
+		}
+		description := state.Description
+		if description == "" {
+			description = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s/%s\t%s\t%s\t%s\t%d\t%s\t%s\n", state.ID, state.Name, state.Context, state.Namespace, state.Target, pod, state.LocalPorts, status, reconnects, uptime, description)
+	}
+	tw.Flush()
+}
+
+// describeState returns the state of a tunnel as ready, connecting,
+// reconnecting, stopped or failed, and how many times it has reconnected.
+func describeState(state TunnelState) (string, int) {
+	reconnects := 0
+	if state.Connects > 1 {
+		reconnects = state.Connects - 1
+	}
+	switch {
+	case state.State == StateUp:
+		return "ready", reconnects
+	case state.State == StateDown && state.Connects == 0:
+		return "connecting", reconnects
+	case state.State == StateDown:
+		return "reconnecting", reconnects
+	}
+	return state.State, reconnects
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	gocontext "context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracer exports spans to an OpenTelemetry collector with OTLP over HTTP,
+// using the JSON encoding. Without otel_endpoint there is no tracer, all
+// spans are nil and the methods on them do nothing.
+type Tracer struct {
+	url    string
+	client *http.Client
+	mutex  sync.Mutex
+	spans  []*Span
+}
+
+var tracer *Tracer
+
+// How often the finished spans are sent, and how many are kept while the
+// collector is unreachable.
+const (
+	traceFlushInterval = 5 * time.Second
+	traceMaxPending    = 2048
+)
+
+// NewTracer returns a tracer that sends the spans to the collector at
+// endpoint, e.g. "http://localhost:4318".
+func NewTracer(endpoint string) *Tracer {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	return &Tracer{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Run sends the finished spans every traceFlushInterval until ctx is
+// cancelled. The rest are sent with Flush before exiting.
+func (this *Tracer) Run(ctx gocontext.Context) {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			this.Flush()
+		}
+	}
+}
+
+// Flush sends the finished spans. They are dropped if the collector can't be
+// reached.
+func (this *Tracer) Flush() {
+	this.mutex.Lock()
+	spans := this.spans
+	this.spans = nil
+	this.mutex.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		Log{}.Warnf("Could not encode %d spans: %s", len(spans), err.Error())
+		return
+	}
+	resp, err := this.client.Post(this.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		Log{}.Warnf("Could not send %d spans to %s: %s", len(spans), this.url, err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		Log{}.Warnf("Could not send %d spans to %s: %s", len(spans), this.url, resp.Status)
+	}
+}
+
+func (this *Tracer) finish(span *Span) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if len(this.spans) < traceMaxPending {
+		this.spans = append(this.spans, span)
+	}
+}
+
+// Span is a timed operation, like a tunnel session or looking up its pod.
+// It is only safe to use from one goroutine at a time.
+type Span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes []spanAttribute
+	events     []spanEvent
+	err        string
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+type spanEvent struct {
+	time time.Time
+	name string
+}
+
+// StartSpan starts a span, as a child of parent if it isn't nil. It returns
+// nil when tracing is off.
+func StartSpan(name string, parent *Span) *Span {
+	if tracer == nil {
+		return nil
+	}
+	span := &Span{
+		name:  name,
+		start: time.Now(),
+	}
+	if parent != nil {
+		span.traceID, span.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// SetAttribute sets an attribute, which is either a string, an int or a bool.
+func (this *Span) SetAttribute(key string, value interface{}) {
+	if this == nil {
+		return
+	}
+	for i := range this.attributes {
+		if this.attributes[i].key == key {
+			this.attributes[i].value = value
+			return
+		}
+	}
+	this.attributes = append(this.attributes, spanAttribute{key, value})
+}
+
+// AddEvent records something that happened during the span.
+func (this *Span) AddEvent(name string) {
+	if this == nil {
+		return
+	}
+	this.events = append(this.events, spanEvent{time: time.Now(), name: name})
+}
+
+// End finishes the span, marking it as failed if err isn't nil, and queues it
+// to be sent.
+func (this *Span) End(err error) {
+	if this == nil {
+		return
+	}
+	this.end = time.Now()
+	if err != nil {
+		this.err = err.Error()
+	}
+	tracer.finish(this)
+}
+
+// The OTLP/JSON encoding of the spans. IDs are hex and the 64-bit integers
+// are strings.
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name         string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpRequest(spans []*Span) interface{} {
+	var encoded []otlpSpan
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.traceID[:]),
+			SpanID:            hex.EncodeToString(span.spanID[:]),
+			Name:              span.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.attributes),
+		}
+		if span.parentID != [8]byte{} {
+			s.ParentSpanID = hex.EncodeToString(span.parentID[:])
+		}
+		for _, event := range span.events {
+			s.Events = append(s.Events, otlpEvent{
+				TimeUnixNano: strconv.FormatInt(event.time.UnixNano(), 10),
+				Name:         event.name,
+			})
+		}
+		if span.err != "" {
+			s.Status = otlpStatus{Code: 2, Message: span.err} // STATUS_CODE_ERROR
+		}
+		encoded = append(encoded, s)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes([]spanAttribute{
+						{"service.name", "kube-tunnel-proxy"},
+						{"service.version", version},
+					}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "kube-tunnel-proxy"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(attributes []spanAttribute) []otlpAttribute {
+	var encoded []otlpAttribute
+	for _, attribute := range attributes {
+		var value map[string]interface{}
+		switch v := attribute.value.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, otlpAttribute{attribute.key, value})
+	}
+	return encoded
+}
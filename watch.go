@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long to wait after the last change to the config
+// file before reloading it, since editors often write a file more than once
+// when saving it.
+const watchDebounce = 500 * time.Millisecond
+
+// watchConfig calls changed in the background whenever the file at path
+// changes. The directory is watched rather than the file, so that editors
+// that save by replacing the file are handled as well.
+func watchConfig(path string, changed func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event := <-watcher.Events:
+				if filepath.Clean(event.Name) != path || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(watchDebounce, changed)
+			case err := <-watcher.Errors:
+				Log{}.Warnf("Watching %s: %s", path, err.Error())
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"k8s.io/client-go/rest"
+)
+
+// The channel protocol that the kubelet speaks for port forwarding over a
+// WebSocket. Every message starts with the channel number, and each port
+// has a data channel and an error channel. The first message on each channel
+// is the port number.
+const (
+	websocketProtocol     = "v4.channel.k8s.io"
+	websocketDataChannel  = 0
+	websocketErrorChannel = 1
+)
+
+// websocketDialer forwards one connection at a time to a pod over a
+// WebSocket, as an alternative to SPDY. client-go doesn't support this yet,
+// so the connection is authenticated with the same TLS config and headers
+// that client-go would use.
+type websocketDialer struct {
+	cfg       *rest.Config
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	keepAlive time.Duration
+	proxy     func(*http.Request) (*url.URL, error)
+}
+
+func newWebsocketDialer(cfg *rest.Config, timeout time.Duration, keepAlive time.Duration, proxyURL string) (*websocketDialer, error) {
+	tlsConfig, err := rest.TLSConfigFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	return &websocketDialer{
+		cfg:       cfg,
+		tlsConfig: tlsConfig,
+		timeout:   timeout,
+		keepAlive: keepAlive,
+		proxy:     proxyFunc(proxyURL),
+	}, nil
+}
+
+// header lets client-go's wrappers add the authentication headers, e.g.
+// from a bearer token or an exec plugin. This is done for every connection
+// since the credentials can change.
+func (this *websocketDialer) header() (http.Header, error) {
+	capture := &headerCapture{}
+	rt, err := rest.HTTPWrappersForConfig(this.cfg, capture)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", this.cfg.Host, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return capture.header, nil
+}
+
+// Dial opens a connection to port on the pod at portForwardURL.
+func (this *websocketDialer) Dial(portForwardURL *url.URL, port int) (io.ReadWriteCloser, error) {
+	location := *portForwardURL
+	origin := url.URL{Scheme: location.Scheme, Host: location.Host}
+	if location.Scheme == "https" {
+		location.Scheme = "wss"
+	} else {
+		location.Scheme = "ws"
+	}
+	location.RawQuery = url.Values{"ports": {strconv.Itoa(port)}}.Encode()
+
+	config, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{websocketProtocol}
+	header, err := this.header()
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		config.Header[key] = values
+	}
+	proxy, err := this.proxy(&http.Request{URL: portForwardURL})
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if portForwardURL.Scheme == "https" {
+		tlsConfig = this.tlsConfig
+	}
+	conn, err := dialThrough(proxy, canonicalAddress(portForwardURL), tlsConfig, this.timeout, this.keepAlive)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return &websocketConn{ws: ws}, nil
+}
+
+// websocketConn is a single forwarded connection.
+type websocketConn struct {
+	ws       *websocket.Conn
+	buf      []byte
+	seenPort [2]bool
+}
+
+func (this *websocketConn) Read(p []byte) (int, error) {
+	for len(this.buf) == 0 {
+		var msg []byte
+		if err := websocket.Message.Receive(this.ws, &msg); err != nil {
+			return 0, err
+		}
+		if len(msg) < 1 || msg[0] > websocketErrorChannel {
+			continue
+		}
+		channel := msg[0]
+		if !this.seenPort[channel] {
+			this.seenPort[channel] = true
+			continue
+		}
+		if channel == websocketErrorChannel {
+			if len(msg) > 1 {
+				return 0, fmt.Errorf("%s", strings.TrimSpace(string(msg[1:])))
+			}
+			continue
+		}
+		this.buf = msg[1:]
+	}
+	n := copy(p, this.buf)
+	this.buf = this.buf[n:]
+	return n, nil
+}
+
+func (this *websocketConn) Write(p []byte) (int, error) {
+	msg := make([]byte, len(p)+1)
+	msg[0] = websocketDataChannel
+	copy(msg[1:], p)
+	if err := websocket.Message.Send(this.ws, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (this *websocketConn) Close() error {
+	return this.ws.Close()
+}
+
+// headerCapture is a fake transport that records the request headers.
+type headerCapture struct {
+	header http.Header
+}
+
+func (this *headerCapture) RoundTrip(req *http.Request) (*http.Response, error) {
+	this.header = req.Header
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}